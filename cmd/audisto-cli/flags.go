@@ -1,10 +1,10 @@
 package main
 
 import (
-	"fmt"
 	"os"
 	"strings"
 
+	"github.com/audisto/data-downloader/pkg/downloader"
 	"github.com/spf13/cobra"
 )
 
@@ -18,10 +18,59 @@ var (
 	output      string // Output format
 	filter      string // Possible filter
 	noResume    bool   // Resume or not any previously downloaded file
+	incremental bool   // Only append the rows added since the previous download
 	noDetails   bool   // Request or not details from Audisto API
 	order       string // Possible order of results
 	mode        string // pages or links
+	format      string // tsv or json
 	targets     string // "self" or a path to a file containing link target pages (IDs)
+	prescan     bool   // Ask the total elements of all the targets first
+
+	targetsColumn  string // Column of the targets file holding the targets
+	outgoing       bool   // Download the links found on the targets
+	targetWorkers  int    // Number of targets downloaded at once
+	targetColumn   bool   // Prepend the page ID of the target to every row
+	outputDir      string // Directory of the files of the targets
+	outputTemplate string // Name of the file of a target
+
+	maxLineLength int      // Maximum length in bytes of a single row
+	strict        bool     // Fail on the first integrity anomaly instead of skipping it
+	onDrift       string   // What to do when the data shifts on the server between chunks
+	driftInterval int      // Check the boundary of every Nth chunk
+	stateFile     string   // Explicit path of the resume file
+	splitRows     uint64   // Maximum number of rows per part file
+	splitSize     string   // Maximum size per part file
+	outputType    string   // tsv or sqlite
+	columns       []string // Columns to write, by header name
+	where         string   // Condition the written rows have to match
+	rowOffset     uint64   // Number of server rows to skip
+	rowLimit      uint64   // Maximum number of server rows to download
+	sample        float64  // Share of the rows to keep
+	sampleSeed    int64    // Seed picking the sampled rows
+	sampleChunks  bool     // Sample blocks of rows instead of single rows
+
+	s3Endpoint  string // S3-compatible endpoint to upload the output to
+	s3Bucket    string // Bucket to upload the output to
+	s3Prefix    string // Prefix of the uploaded object key
+	s3Region    string // Region of the bucket
+	s3AccessKey string // S3 access key
+	s3SecretKey string // S3 secret key
+	s3Insecure  bool   // Use plain HTTP to talk to the endpoint
+	s3PartSize  string // Size of the uploaded parts
+
+	manifestFile string // Path of a manifest listing several downloads
+
+	maxRate              string // Maximum bytes read per second
+	maxRequestsPerMinute int    // Maximum requests made per minute
+
+	webhooks      []string // URLs notified once a download completed or failed
+	webhookSecret string   // Secret signing the webhook requests
+	onComplete    string   // Command run once a download completed
+	onError       string   // Command run when a download failed
+
+	logFile   string // Path of the log file
+	logLevel  string // Minimum level of the logged messages
+	logFormat string // text or json
 )
 
 // register global flags that apply to the root command
@@ -32,11 +81,71 @@ func registerPersistentFlags(rootCmd *cobra.Command) {
 	pf.Uint64VarP(&crawlID, "crawl", "c", 0, "ID of the crawl to download (required)")
 	pf.StringVarP(&mode, "mode", "m", "pages", "Download mode, set it to 'links' or 'pages' (default)")
 	pf.BoolVarP(&noDetails, "no-details", "d", false, "If passed, details in API request is set to 0")
-	pf.StringVarP(&output, "output", "o", "", "Path for the output file")
+	pf.StringVarP(&output, "output", "o", "", "Path for the output file, '-' to write to stdout")
 	pf.BoolVarP(&noResume, "no-resume", "r", false, "If passed, download starts again, else the download is resumed")
+	pf.BoolVarP(&incremental, "incremental", "", false, "If passed, only the rows added since the previous download are appended to the output, when the rows before did not change")
 	pf.StringVarP(&filter, "filter", "f", "", "Filter all pages by some attributes")
 	pf.StringVarP(&order, "order", "", "", "Order by some attributes")
-	pf.StringVarP(&targets, "targets", "t", "", `"self" or a path to a file containing link target pages (IDs)`)
+	pf.StringVarP(&format, "format", "", downloader.FormatTSV, "Format the chunks are requested in, 'tsv' or 'json'. JSON keeps the nested fields as JSON text")
+	pf.StringVarP(&targets, "targets", "t", "", `"self", a path to a file containing link target pages (IDs or URLs), or '-' to read them from stdin`)
+	pf.StringVarP(&targetsColumn, "targets-column", "", "", "Read the targets from a column (name or number) of a CSV or TSV targets file with a header")
+	pf.BoolVarP(&outgoing, "outgoing", "", false, "If passed, the links found on the targets are downloaded instead of the links to them")
+	pf.BoolVarP(&prescan, "prescan", "", false, "If passed, the total elements of all the targets are asked first, for an overall progress. Empty targets are skipped")
+	pf.IntVarP(&targetWorkers, "target-workers", "", downloader.DefaultTargetWorkers, "Number of targets downloaded at once, their rows are written in the order of the targets file")
+	pf.BoolVarP(&targetColumn, "target-column", "", false, "If passed, the page ID of the target is prepended to every row, in a target_page_id column")
+	pf.StringVarP(&outputDir, "output-dir", "", "", "If set, every target is written to its own file in this directory, the output lists the files")
+	pf.StringVarP(&outputTemplate, "output-template", "", downloader.DefaultOutputTemplate, "Name of the file of a target in --output-dir, with {target}, {index}, {crawl} and {mode}")
+	pf.IntVarP(&maxLineLength, "max-line-length", "", downloader.DefaultMaxLineLength, "Maximum length in bytes of a single row")
+	pf.BoolVarP(&strict, "strict", "", false, "If passed, the download fails on invalid chunks instead of skipping them")
+	pf.StringVarP(&stateFile, "state-file", "", "", "Path for the resume file, required to resume a download written to stdout")
+	pf.Uint64VarP(&splitRows, "split-rows", "", 0, "Split the output into part files of at most N rows each")
+	pf.StringVarP(&splitSize, "split-size", "", "", "Split the output into part files of at most SIZE each (e.g. 500MB, 2G)")
+	pf.StringSliceVarP(&columns, "columns", "", nil, "Comma separated columns to write, by header name (default all)")
+	pf.StringVarP(&where, "where", "", "", `Only write the rows matching a condition, e.g. 'status_code >= 400 && url ~ "/blog/"'`)
+	pf.Uint64VarP(&rowOffset, "offset", "", 0, "Skip the first N rows")
+	pf.Uint64VarP(&rowLimit, "limit", "", 0, "Download at most N rows (default all)")
+	pf.Float64VarP(&sample, "sample", "", 0, "Only write a random share of the rows, e.g. 0.01 for 1%")
+	pf.Int64VarP(&sampleSeed, "sample-seed", "", downloader.DefaultSampleSeed, "Seed picking the sampled rows, the same seed gives the same sample")
+	pf.BoolVarP(&sampleChunks, "sample-chunks", "", false, "If passed, blocks of 1000 rows are sampled and only those are downloaded")
+	pf.StringVarP(&outputType, "output-type", "", "", "Output type, 'tsv' or 'sqlite'. Guessed from the output extension (.sqlite, .db) if not set")
+	pf.StringVarP(&s3Endpoint, "s3-endpoint", "", "s3.amazonaws.com", "S3-compatible endpoint to upload the output to")
+	pf.StringVarP(&s3Bucket, "s3-bucket", "", "", "If set, the output is uploaded to this bucket instead of being written to a local file")
+	pf.StringVarP(&s3Prefix, "s3-prefix", "", "", "Prefix of the uploaded object, followed by the name of the output")
+	pf.StringVarP(&s3Region, "s3-region", "", "", "Region of the bucket, looked up if not set")
+	pf.StringVarP(&s3AccessKey, "s3-access-key", "", "", "S3 access key, defaults to $AWS_ACCESS_KEY_ID")
+	pf.StringVarP(&s3SecretKey, "s3-secret-key", "", "", "S3 secret key, defaults to $AWS_SECRET_ACCESS_KEY")
+	pf.BoolVarP(&s3Insecure, "s3-insecure", "", false, "If passed, the endpoint is reached over plain HTTP (e.g. a local MinIO)")
+	pf.StringVarP(&s3PartSize, "s3-part-size", "", "16MB", "Size of the uploaded parts, at least 5MB")
+	pf.StringVarP(&manifestFile, "manifest", "", "", "Path of a YAML or JSON manifest listing several downloads to run one after the other")
+	pf.StringVarP(&maxRate, "max-rate", "", "", "Read at most SIZE per second from Audisto API (e.g. 500KB, 2MB), no limit if not set")
+	pf.IntVarP(&maxRequestsPerMinute, "max-requests-per-minute", "", 0, "Make at most N requests per minute to Audisto API (default no limit)")
+	pf.StringVarP(&onDrift, "on-drift", "", downloader.DriftWarn, "When the data shifts between chunks: 'warn', 'redownload', 'fail' or 'off'")
+	pf.IntVarP(&driftInterval, "drift-interval", "", downloader.DefaultDriftInterval, "Check the boundary of every Nth chunk with a request of its own, 1 for every chunk")
+	pf.StringSliceVarP(&webhooks, "webhook", "", nil, "URL posted a JSON event once the download completed or failed, can be repeated")
+	pf.StringVarP(&webhookSecret, "webhook-secret", "", "", "Secret signing the webhook requests (HMAC-SHA256), defaults to $DD_WEBHOOK_SECRET")
+	pf.StringVarP(&onComplete, "on-complete", "", "", "Shell command run once the download completed, with the DD_* environment variables")
+	pf.StringVarP(&onError, "on-error", "", "", "Shell command run when the download failed, with the DD_* environment variables")
+	pf.StringVarP(&logFile, "log-file", "", "", "If set, messages and download events are logged to this file, rotated at 10MB")
+	pf.StringVarP(&logLevel, "log-level", "", "info", "Minimum level of the logged messages: 'debug', 'info', 'warning' or 'error'")
+	pf.StringVarP(&logFormat, "log-format", "", downloader.LogFormatText, "Format of the log file, 'text' or 'json'")
+}
+
+// openLogger opens the log file set by --log-file, no logger is returned without one
+func openLogger() (*downloader.Logger, error) {
+	level, err := downloader.ParseLogLevel(logLevel)
+	if err != nil {
+		return nil, CError("%v", err)
+	}
+	if logFile == "" {
+		return nil, nil
+	}
+	logger, err := downloader.OpenLogger(logFile, level, strings.ToLower(strings.TrimSpace(logFormat)))
+	if err != nil {
+		return nil, CError("%v", err)
+	}
+	// the credentials passed on the command line are never logged
+	logger.Redact(password, s3SecretKey, s3AccessKey, webhookSecret)
+	return logger, nil
 }
 
 // check if --username --password and --crawl are being passed with non-empty values
@@ -63,69 +172,218 @@ func customFlagsParse(cmd *cobra.Command, args []string) error {
 }
 
 // Beside parsing flags and auto-type inferring offered by Cobra package
-// we check for our own flag validations/logic as well
-func customFlagsValidation(cmd *cobra.Command) error {
-	// make sure required flags are passed
-	if !requiredFlagsPassed() {
-		return CError("--username, --password and --crawl are required")
+// we check for our own flag validations/logic as well, it returns the downloads to run
+func customFlagsValidation(cmd *cobra.Command) ([]downloader.Options, error) {
+	// make sure required flags are passed, a manifest may hold them instead
+	if manifestFile == "" && !requiredFlagsPassed() {
+		return nil, CError("--username, --password and --crawl are required")
 	}
 
 	// normalize flags before proceeding with the validation
 	normalizeFlags()
 
-	// validate mode
-	if mode != "" && mode != "pages" && mode != "links" {
-		msg := "mode has to be 'links' or 'pages', if this flag is dropped, it will default to 'pages'"
-		return CError(msg)
+	if manifestFile != "" {
+		return manifestOptions()
 	}
 
-	// validate targets / mode / filter combinations
-	if targets != "" {
+	options, err := flagOptions()
+	if err != nil {
+		return nil, err
+	}
+	if err = options.Validate(); err != nil {
+		return nil, CError("%v", err)
+	}
+	// returning no error means the validation passed
+	return []downloader.Options{options}, nil
+}
+
+// flagOptions gathers the download options passed as flags
+func flagOptions() (downloader.Options, error) {
+	options := downloader.Options{
+		Username:      username,
+		Password:      password,
+		Crawl:         crawlID,
+		Mode:          mode,
+		NoDetails:     noDetails,
+		Filter:        filter,
+		Order:         order,
+		Format:        format,
+		Targets:       targets,
+		Prescan:       prescan,
+		Output:        output,
+		NoResume:      noResume,
+		Incremental:   incremental,
+		StateFile:     stateFile,
+		OutputType:    outputType,
+		SplitRows:     splitRows,
+		ChunkNumber:   chunkNumber,
+		ChunkSize:     chunkSize,
+		MaxLineLength: maxLineLength,
+		Strict:        strict,
+		DriftCheck:    onDrift,
+		DriftInterval: driftInterval,
+		Columns:       columns,
+		Where:         where,
+		Offset:        rowOffset,
+		Limit:         rowLimit,
+		Sample:        sample,
+		SampleSeed:    sampleSeed,
+		SampleChunks:  sampleChunks,
+		Hooks:         flagHooks(),
+
+		MaxRequestsPerMinute: maxRequestsPerMinute,
+		TargetWorkers:        targetWorkers,
+		TargetsColumn:        targetsColumn,
+		Outgoing:             outgoing,
+		TargetColumn:         targetColumn,
+		OutputDir:            outputDir,
+		OutputTemplate:       outputTemplate,
+	}
 
-		// do not allow --filter when --targets is being used with a FILEPATH
-		if filter != "" && targets != "self" {
-			return CError("Set either --filter or --targets, but not both. Except when --targets=self")
+	rate, err := flagMaxRate()
+	if err != nil {
+		return options, err
+	}
+	options.MaxRate = rate
+
+	if splitSize != "" {
+		size, err := downloader.ParseByteSize(splitSize)
+		if err != nil {
+			return options, CError("--split-size: %v", err)
 		}
+		options.SplitSize = size
+	}
 
-		// --mode=pages is only allowed when targets=self
-		if targets == "self" && mode != "pages" {
-			return CError("Set --mode=pages to use --targets=self")
+	if s3Bucket != "" {
+		size, err := downloader.ParseByteSize(s3PartSize)
+		if err != nil {
+			return options, CError("--s3-part-size: %v", err)
 		}
+		if size < downloader.MinS3PartSize {
+			return options, CError("--s3-part-size has to be at least 5MB")
+		}
+		options.S3 = &downloader.S3Config{
+			Endpoint:  s3Endpoint,
+			Bucket:    s3Bucket,
+			Prefix:    s3Prefix,
+			Region:    s3Region,
+			AccessKey: s3AccessKey,
+			SecretKey: s3SecretKey,
+			Insecure:  s3Insecure,
+			PartSize:  size,
+		}
+	}
+	return options, nil
+}
 
-		// --targets=FILEPATH is only allowed when mode is set to links
-		// we'd also make sure the file exists.
-		if targets != "self" {
+// flagMaxRate parses --max-rate, 0 meaning no limit
+func flagMaxRate() (int64, error) {
+	if maxRate == "" {
+		return 0, nil
+	}
+	rate, err := downloader.ParseByteSize(maxRate)
+	if err != nil {
+		return 0, CError("--max-rate: %v", err)
+	}
+	return rate, nil
+}
 
-			if mode != "links" {
-				return CError("Set --mode=links to use --targets=FILEPATH")
-			}
+// flagHooks returns the hooks passed as flags, nil if there is none
+func flagHooks() *downloader.Hooks {
+	if len(webhooks) == 0 && webhookSecret == "" && onComplete == "" && onError == "" {
+		return nil
+	}
+	return &downloader.Hooks{Webhooks: webhooks, Secret: webhookSecret, OnComplete: onComplete, OnError: onError}
+}
 
-			if _, err := os.Stat(targets); os.IsNotExist(err) {
-				return CError(fmt.Sprintf("%s file does not exist", targets))
-			}
-		}
+// manifestOptions reads the downloads of --manifest, the credentials, hooks and rate
+// limits passed as flags apply to the downloads that don't set their own
+func manifestOptions() ([]downloader.Options, error) {
+	manifest, err := downloader.LoadManifest(manifestFile)
+	if err != nil {
+		return nil, CError("--manifest: %v", err)
+	}
+	rate, err := flagMaxRate()
+	if err != nil {
+		return nil, err
+	}
 
+	for i := range manifest.Downloads {
+		download := &manifest.Downloads[i]
+		fillFromFlags(download, rate)
+		if err = download.Validate(); err != nil {
+			return nil, CError("--manifest, download %d: %v", i+1, err)
+		}
 	}
-	// returning no error means the validation passed
-	return nil
+	return manifest.Downloads, nil
 }
 
-// trim spaces and lowercase [some] string-based flags
-func normalizeFlags() {
+// pipelineOptions reads the pipeline definition file, the credentials, the crawl, hooks
+// and rate limits passed as flags apply to the stages that don't set their own
+func pipelineOptions(path string) (*downloader.Pipeline, error) {
+	pipeline, err := downloader.LoadPipeline(path)
+	if err != nil {
+		return nil, CError("pipeline: %v", err)
+	}
+	rate, err := flagMaxRate()
+	if err != nil {
+		return nil, err
+	}
 
-	// trim spaces for 'mode', 'targets', 'output', 'filter' and 'order'
-	mode = strings.TrimSpace(mode)
-	targets = strings.TrimSpace(targets)
-	output = strings.TrimSpace(output)
-	filter = strings.TrimSpace(filter)
-	order = strings.TrimSpace(order)
+	if pipeline.Username == "" && pipeline.Password == "" {
+		pipeline.Username, pipeline.Password = username, password
+	}
+	if pipeline.Crawl == 0 {
+		pipeline.Crawl = crawlID
+	}
+	pipeline.NoResume = pipeline.NoResume || noResume
+	for i := range pipeline.Stages {
+		stage := &pipeline.Stages[i].Options
+		if stage.Username == "" && stage.Password == "" {
+			stage.Username, stage.Password = pipeline.Username, pipeline.Password
+		}
+		fillFromFlags(stage, rate)
+	}
+	if err = pipeline.Validate(); err != nil {
+		return nil, CError("pipeline: %v", err)
+	}
+	return pipeline, nil
+}
 
-	// lowercase 'mode'
-	mode = strings.ToLower(mode)
+// fillFromFlags fills in the settings of a download of a manifest or a pipeline that are
+// taken from the flags when it doesn't set its own
+func fillFromFlags(download *downloader.Options, rate int64) {
+	if download.Username == "" && download.Password == "" {
+		download.Username, download.Password = username, password
+	}
+	if download.S3 != nil && download.S3.AccessKey == "" && download.S3.SecretKey == "" {
+		download.S3.AccessKey, download.S3.SecretKey = s3AccessKey, s3SecretKey
+	}
+	if download.Hooks == nil {
+		download.Hooks = flagHooks()
+	}
+	if download.MaxRate == 0 {
+		download.MaxRate = rate
+	}
+	if download.MaxRequestsPerMinute == 0 {
+		download.MaxRequestsPerMinute = maxRequestsPerMinute
+	}
+	if download.TargetWorkers == 0 {
+		download.TargetWorkers = targetWorkers
+	}
+}
 
-	// lowercase 'targets' when it's being set to 'self'
-	if strings.EqualFold(targets, "self") {
-		targets = "self"
+// fill in the flags taken from the environment, the options themselves are trimmed
+// and lowercased by their validation
+func normalizeFlags() {
+	if s3AccessKey == "" {
+		s3AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if s3SecretKey == "" {
+		s3SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if webhookSecret == "" && len(webhooks) > 0 {
+		webhookSecret = os.Getenv("DD_WEBHOOK_SECRET")
 	}
 }
 
@@ -135,5 +393,13 @@ func getExamples() string {
 	return fStringYellow(`
 $ data-downloader --username="USERNAME" --password="PASSWORD" --crawl=12345 --output="myCrawl.tsv"
 $ data-downloader -u="USERNAME" -p="PASSWORD" -c=12345 -o="myCrawl.tsv" --no-resume -m=links
+$ data-downloader -u="USERNAME" -p="PASSWORD" -c=12345 -o=- | gzip > myCrawl.tsv.gz
+$ data-downloader -u="USERNAME" -p="PASSWORD" -c=12345 -o="myCrawl.sqlite"
+$ data-downloader -u="USERNAME" -p="PASSWORD" -c=12345 -o="peek.tsv" --limit=1000
+$ data-downloader -u="USERNAME" -p="PASSWORD" -c=12345 -o="errors.tsv" --columns=url,status_code --where="status_code >= 400"
+$ data-downloader -u="USERNAME" -p="PASSWORD" -c=12345 -o="myCrawl.tsv" --s3-bucket=exports --s3-prefix=crawls/
+$ data-downloader -u="USERNAME" -p="PASSWORD" --manifest=downloads.yaml
+$ data-downloader pipeline broken-links.yaml -u="USERNAME" -p="PASSWORD" -c=12345
+$ data-downloader -u="USERNAME" -p="PASSWORD" -c=12345 -o="myCrawl.tsv" --on-error='mail -s "Download of $DD_CRAWL failed: $DD_ERROR" me@example.com'
 `)
 }
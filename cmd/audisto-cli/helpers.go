@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"strings"
 	"time"
+
+	"github.com/audisto/data-downloader/pkg/downloader"
 )
 
 const (
@@ -13,9 +15,6 @@ const (
 	megabyte = 1024 * kilobyte
 	gigabyte = 1024 * megabyte
 	terabyte = 1024 * gigabyte
-
-	// ETAFactor ETA milliseconds estimation factor
-	ETAFactor = 175
 )
 
 // PrettyByteSize returns a human-readable byte string of the form 10M, 12.5K, and so forth.  The following units are available:
@@ -54,6 +53,11 @@ func PrettyByteSize(bytes uint64) string {
 	return fmt.Sprintf("%s%s", stringValue, unit)
 }
 
+// writesToStdout check if the downloaded rows are written to stdout
+func writesToStdout(output string) bool {
+	return output == "" || output == downloader.StdoutFilename
+}
+
 // PrettyTime returns the string representation of the duration. It rounds the time duration to a second and returns a "---" when duration is 0
 func PrettyTime(t time.Duration) string {
 	if t == 0 {
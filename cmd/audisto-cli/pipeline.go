@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/audisto/data-downloader/pkg/downloader"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(pipelineCmd)
+}
+
+var pipelineCmd = &cobra.Command{
+	Use:   "pipeline FILE",
+	Short: "Run the stages of a pipeline definition file",
+	Long: `Run the stages of a YAML or JSON pipeline definition file one after the other,
+a stage being able to download the links of the pages found by an earlier stage.
+A pages stage fed by an earlier stage still downloads every page matching its filter and
+keeps the rows of the pages found only, narrow it down with a filter when possible`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger, err := openLogger()
+		if err != nil {
+			return err
+		}
+		defer logger.Close()
+		normalizeFlags()
+
+		pipeline, err := pipelineOptions(args[0])
+		if err != nil {
+			logger.Error("invalid pipeline", "error", err)
+			return err
+		}
+		return pipeline.Run(func(index int, stage *downloader.Stage, setup func(*downloader.Downloader) error) error {
+			// keep stdout clean when the rows themselves are written to it
+			if !writesToStdout(stage.Output) {
+				PrintBlue("Stage %d of %d: %s", index+1, len(pipeline.Stages), stage.Name)
+			}
+			return runDownload(stage.Options, logger.With("stage", stage.Name), setup)
+		})
+	},
+}
@@ -2,25 +2,74 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/mattn/go-colorable"
-
 	"github.com/audisto/data-downloader/pkg/downloader"
 	"github.com/gosuri/uilive"
 	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
-// RenderProgress render the progressbar animation and the download status information
-func RenderProgress(progressReport <-chan downloader.StatusReport) {
-	// Make a realtime Stdout writer using uilive
+// maxListedAnomalies the number of anomalies listed once the download is completed
+const maxListedAnomalies = 20
+
+// maxLogMessages the number of recent log messages rendered above the progress bar
+const maxLogMessages = 10
+
+// progressLog observes the log messages of the download, the most recent ones are
+// rendered above the progress bar
+type progressLog struct {
+	downloader.NopObserver
+	mu       sync.Mutex
+	messages []string
+	// dropped the number of messages no longer rendered
+	dropped int
+}
+
+// OnLog keeps the message, colored after its level
+func (l *progressLog) OnLog(level downloader.LogType, message string) {
+	switch level {
+	case downloader.INFO:
+		message = StringBlue(message) + "\n"
+	case downloader.WARNING:
+		message = StringYellow("WARNING: " + message)
+	default:
+		message = StringYellow(message) + "\n"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.messages) == maxLogMessages {
+		l.messages = l.messages[1:]
+		l.dropped++
+	}
+	l.messages = append(l.messages, message)
+}
+
+func (l *progressLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	messages := strings.Join(l.messages, "")
+	if l.dropped > 0 {
+		messages = StringYellow(fmt.Sprintf("(%d earlier messages)", l.dropped)) + "\n" + messages
+	}
+	return messages
+}
+
+// RenderProgress render the progressbar animation and the download status information to out,
+// along with the messages of logs
+func RenderProgress(progressReport <-chan downloader.StatusReport, logs fmt.Stringer, out io.Writer) {
+	// Make a realtime writer using uilive
 	writer := uilive.New()
+	writer.Out = out
 	// Make a new progres bar with 100 as its target/percentage
 	bar := pb.New(100)
 	var bar2 *pb.ProgressBar
+	var overallBar *pb.ProgressBar
 
 	// By default, the percentage is 0, to be incremented by the progress report
 	// percentage := 0
@@ -59,18 +108,7 @@ func RenderProgress(progressReport <-chan downloader.StatusReport) {
 		// clean the message on each new iteration
 		msg = "\n"
 		// print the log messages received, BEFORE the progress bar rendering
-		for _, f := range progress.Logs {
-			for key, value := range f {
-				switch key {
-				case downloader.INFO:
-					msg += StringBlue(value) + "\n"
-				case downloader.WARNING:
-					msg += StringYellow("WARNING: " + value)
-				default:
-					msg += StringYellow(value) + "\n"
-				}
-			}
-		}
+		msg += logs.String()
 
 		if progress.IsIngTargetMode {
 			if bar2 == nil && progress.TotalIDsCount > 0 {
@@ -93,8 +131,30 @@ func RenderProgress(progressReport <-chan downloader.StatusReport) {
 			}
 		}
 
+		// the rows of all the targets, once pre-scanned
+		if progress.OverallTotalElements > 0 {
+			if overallBar == nil {
+				overallBar = pb.New(100)
+				overallBar.ShowCounters = false
+				overallBar.ShowTimeLeft = false
+				overallBar.ManualUpdate = true
+				overallBar.Output = nil
+				overallBar.NotPrint = true
+				overallBar.Format("╢▌▌░╟")
+			}
+			overallBar.Prefix(fmt.Sprintf("Overall %d of %d rows |", progress.OverallDoneElements, progress.OverallTotalElements))
+			overallBar.Set(int(math.Floor(progress.OverallPercentage)))
+			overallBar.Update()
+			msg += "\n" + strings.Replace(overallBar.String(), "%", "%%", -1) + "\n"
+		}
+
 		// build up the progress bar
-		preMsg := fmt.Sprintf("ETA %s |", progress.ETA)
+		preMsg := fmt.Sprintf("ETA %s |", PrettyTime(progress.ETA))
+		if progress.IsIngTargetMode {
+			preMsg += fmt.Sprintf(" Target ETA %s |", PrettyTime(progress.TargetETA))
+		}
+		preMsg += fmt.Sprintf(" %.0f rows/s, %s/s |", progress.RowsPerSecond, PrettyByteSize(uint64(progress.BytesPerSecond)))
+		preMsg += fmt.Sprintf(" Elapsed %s |", PrettyTime(progress.Elapsed))
 		preMsg += fmt.Sprintf(" Chunk size %d |", progress.ChunkSize)
 		preMsg += fmt.Sprintf("%d of %d %s |", progress.DoneElements, progress.TotalElements, progress.Mode)
 		preMsg += fmt.Sprintf(" %d Timeouts |", progress.TimeoutsCount)
@@ -104,13 +164,9 @@ func RenderProgress(progressReport <-chan downloader.StatusReport) {
 		bar.Set(int(percentage))
 		bar.Update() // manuall update it
 
-		// the percentage sign '%' of the progress bar is confusing to the writer
-		// so we'd escape it before rendering the progress bar.
-		bar := "\n" + strings.Replace(bar.String(), "%", "%%", -1)
-
-		msg += bar
+		msg += "\n" + bar.String()
 		// write all of the above to uilive writer
-		fmt.Fprintf(writer, msg+"\n")
+		fmt.Fprint(writer, msg+"\n")
 		// clear the msg
 		msg = ""
 		// flush the previous writer buffer
@@ -123,12 +179,24 @@ func RenderProgress(progressReport <-chan downloader.StatusReport) {
 	finishMessage := "\n\nDownload Completed in " + PrettyTime(time.Since(startTime))
 
 	fi, e := os.Stat(lastProgress.OutputFilename)
-	if e == nil {
+	if e == nil && !writesToStdout(lastProgress.OutputFilename) {
 		filesize := uint64(fi.Size())
 		filesizeStr := PrettyByteSize(filesize)
 		finishMessage += fmt.Sprintf("\nGot %s Saved to: %s", filesizeStr, lastProgress.OutputFilename)
 	}
 
 	msg += fStringGreen(finishMessage)
-	fmt.Fprintf(colorable.NewColorableStdout(), msg+"\n")
+
+	// list what was skipped, so it doesn't go unnoticed
+	if len(lastProgress.Anomalies) > 0 {
+		msg += "\n" + fStringYellow(downloader.SummarizeAnomalies(lastProgress.Anomalies))
+		for i, anomaly := range lastProgress.Anomalies {
+			if i == maxListedAnomalies {
+				msg += fStringYellow(fmt.Sprintf("\n  ... and %d more", len(lastProgress.Anomalies)-i))
+				break
+			}
+			msg += fStringYellow("\n  - " + anomaly.String())
+		}
+	}
+	fmt.Fprint(out, msg+"\n")
 }
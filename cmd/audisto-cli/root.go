@@ -24,14 +24,26 @@ var RootCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		logger, err := openLogger()
+		if err != nil {
+			return err
+		}
+		defer logger.Close()
+
 		// Run our custom flags [values] validation
-		err = customFlagsValidation(cmd)
+		downloads, err := customFlagsValidation(cmd)
 		if err != nil {
+			logger.Error("invalid flags", "error", err)
 			return err
 		}
 
-		// all looks good, perform the download
-		return performDownload()
+		// all looks good, perform the downloads
+		for i, options := range downloads {
+			if err = performDownload(options, logger.With("download", i+1)); err != nil {
+				return err
+			}
+		}
+		return nil
 	},
 }
 
@@ -43,18 +55,32 @@ func init() {
 }
 
 // use Audisto downloader package to initiate/resume API downloads
-func performDownload() error {
+func performDownload(options downloader.Options, logger *downloader.Logger) error {
+	return runDownload(options, logger, func(download *downloader.Downloader) error {
+		return download.SetupOptions(options)
+	})
+}
+
+// runDownload sets up a download with setup and renders its progress while it runs
+func runDownload(options downloader.Options, logger *downloader.Logger, setup func(*downloader.Downloader) error) error {
 	progressReport := make(chan downloader.StatusReport)
 	download := downloader.New(progressReport)
+	download.Logger = logger
+	logs := &progressLog{}
+	download.Subscribe(logs)
 
-	err := download.Setup(username, password, crawlID, mode, noDetails,
-		chunkNumber, chunkSize, output, filter, noResume, order, targets)
-
+	err := setup(download)
 	if err != nil {
+		logger.Error("download setup failed", "crawl", options.Crawl, "output", options.Output, "error", err)
 		return err
 	}
 
-	go RenderProgress(progressReport)
+	// keep stdout clean when the rows, or the index of the targets files, are written to it
+	progressOutput := colorable.NewColorableStdout()
+	if writesToStdout(options.Output) {
+		progressOutput = colorable.NewColorableStderr()
+	}
+	go RenderProgress(progressReport, logs, progressOutput)
 
 	err = download.Start()
 	if err != nil {
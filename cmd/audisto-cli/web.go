@@ -19,7 +19,14 @@ var webCmd = &cobra.Command{
 	Short: "Launch a local web interface of data-downloader",
 	Long:  `Launch a local web interface of data-downloader`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		web.StartWebInterface(port, false)
+		logger, err := openLogger()
+		if err != nil {
+			return err
+		}
+		defer logger.Close()
+		normalizeFlags()
+		// the hooks passed as flags apply to every download started from the web interface
+		web.StartWebInterface(port, false, logger, flagHooks())
 		return nil
 	},
 }
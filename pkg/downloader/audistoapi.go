@@ -3,6 +3,7 @@ package downloader
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -65,8 +66,14 @@ type AudistoAPIClient struct {
 	ChunkNumber uint64
 	ChunkSize   uint64
 
+	// Outgoing the target page filter selects the links found on the page instead of
+	// the links to it, see SetTargetPageFilter
+	Outgoing bool
+
 	// HTTP Client
 	httpClient http.Client
+	// limits of the requests and of the bandwidth, see SetMaxRate
+	limits *rateLimits
 
 	// meta
 	requestMethod string
@@ -94,6 +101,7 @@ func NewClient(username string, password string, crawl uint64, mode string,
 		Order:       strings.TrimSpace(order),
 		Filter:      strings.TrimSpace(filter),
 		ChunkNumber: chunknumber,
+		limits:      &rateLimits{},
 	}
 	client.SetChunkSize(chunkSize)
 	return client, client.IsValid()
@@ -224,7 +232,13 @@ func (api *AudistoAPIClient) SetRequestMethod(method string) error {
 	return nil
 }
 
+// SetTargetPageFilter selects the links to the given page, or the links found on it when
+// Outgoing is set
 func (api *AudistoAPIClient) SetTargetPageFilter(pageID uint64) {
+	if api.Outgoing {
+		api.Filter = fmt.Sprintf("source_page:%d", pageID)
+		return
+	}
 	api.Filter = fmt.Sprintf("target_page:%d", pageID)
 }
 
@@ -252,15 +266,26 @@ func (api *AudistoAPIClient) Do(request *http.Request) (*http.Response, error) {
 	request.Header.Add("Connection", ConnectionType)
 	request.Header.Add("Accept-Encoding", AcceptEncoding)
 	request.Header.Add("Content-Type", ContentType)
+
+	// wait for the request to be within --max-requests-per-minute
+	if err := api.rateLimits().requests.take(request.Context(), 1); err != nil {
+		return nil, err
+	}
 	return api.httpClient.Do(request)
 }
 
-// FetchRawChunk makes an http request to the server for a given chunk
-func (api *AudistoAPIClient) FetchRawChunk(forTheFirstRequest bool) ([]byte, int, error) {
+// FetchChunk makes an http request to the server for a given chunk and returns the
+// (decompressed) response body as a stream. The caller is responsible for closing it.
+func (api *AudistoAPIClient) FetchChunk(forTheFirstRequest bool) (io.ReadCloser, int, error) {
+	return api.FetchChunkContext(context.Background(), forTheFirstRequest)
+}
+
+// FetchChunkContext is FetchChunk with a context cancelling the request
+func (api *AudistoAPIClient) FetchChunkContext(ctx context.Context, forTheFirstRequest bool) (io.ReadCloser, int, error) {
 
 	requestURL, err := api.GetRequestURL()
 	if err != nil {
-		return []byte(""), 0, err
+		return nil, 0, err
 	}
 	bodyParameters := url.Values{}
 	requestURL.RawQuery = api.GetQueryParams(forTheFirstRequest).Encode()
@@ -268,36 +293,58 @@ func (api *AudistoAPIClient) FetchRawChunk(forTheFirstRequest bool) ([]byte, int
 	request, err := http.NewRequest(
 		api.GetRequestMethod(), requestURL.String(),
 		bytes.NewBufferString(bodyParameters.Encode()))
+	// the URL holds the credentials
 	if err != nil {
-		return []byte(""), 0, fmt.Errorf("Failed to get the URL %s: %s", requestURL, err)
+		return nil, 0, fmt.Errorf("Failed to get the URL %s: %s", RedactURL(requestURL.String()), err)
 	}
 
-	response, err := api.Do(request)
+	response, err := api.Do(request.WithContext(ctx))
 	if err != nil {
-		return []byte(""), 0, fmt.Errorf("Failed to get the URL %s: %s", requestURL, err)
+		return nil, 0, fmt.Errorf("Failed to get the URL %s: %s", RedactURL(requestURL.String()), RedactURL(err.Error()))
 	}
+	// the bandwidth is the one of the compressed body
+	response.Body = &limitedBody{ReadCloser: response.Body, ctx: ctx, limits: api.rateLimits()}
 
-	defer response.Body.Close()
-
-	var responseReader io.ReadCloser
 	switch response.Header.Get("Content-Encoding") {
 	case "gzip":
 		decompressedBodyReader, err := gzip.NewReader(response.Body)
 		if err != nil {
-			return []byte(""), response.StatusCode, err
+			response.Body.Close()
+			return nil, response.StatusCode, err
 		}
-		responseReader = decompressedBodyReader
-		defer responseReader.Close()
+		return &gzipBody{Reader: decompressedBodyReader, body: response.Body}, response.StatusCode, nil
 	default:
-		responseReader = response.Body
+		return response.Body, response.StatusCode, nil
 	}
+}
+
+// FetchRawChunk makes an http request to the server for a given chunk and reads it whole
+func (api *AudistoAPIClient) FetchRawChunk(forTheFirstRequest bool) ([]byte, int, error) {
+
+	body, statusCode, err := api.FetchChunk(forTheFirstRequest)
+	if err != nil {
+		return []byte(""), statusCode, err
+	}
+	defer body.Close()
 
-	responseBody, err := ioutil.ReadAll(responseReader)
+	responseBody, err := ioutil.ReadAll(body)
 	if err != nil {
-		return []byte(""), response.StatusCode, err
+		return []byte(""), statusCode, err
 	}
 
-	return responseBody, response.StatusCode, nil
+	return responseBody, statusCode, nil
+}
+
+// gzipBody decompresses a gzip encoded response body, closing both the
+// decompressor and the underlying body once done.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g *gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
 }
 
 // FetchTotalElements sets up the request for the first chunk in json,
@@ -0,0 +1,257 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// extraColumns the `column` tag of the map field holding the columns without a field
+const extraColumns = "*"
+
+// RowDecoder maps the columns of the rows to the fields of a struct such as Page or
+// LinkDetails, by their `column` tag and according to the header, converting the values
+// to the type of the fields. The columns without a field go to the map tagged
+// `column:"*"`, if any.
+//
+//	decoder, err := downloader.NewRowDecoder(rows.Header(), downloader.Page{})
+//	var page downloader.Page
+//	err = decoder.Decode(rows.Row(), &page)
+type RowDecoder struct {
+	model  reflect.Type
+	header []string
+	// fields the index of the field of every header column, nil when it has none
+	fields [][]int
+	// byName the index of the fields by column name
+	byName map[string][]int
+	// extra the index of the map of the columns without a field, nil when there is none
+	extra []int
+}
+
+// NewRowDecoder creates a decoder of the rows with the given header into values of the
+// type of model, a struct or a pointer to a struct
+func NewRowDecoder(header []string, model interface{}) (*RowDecoder, error) {
+	t := reflect.TypeOf(model)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("rows can only be decoded into structs, not %v", t)
+	}
+
+	dec := &RowDecoder{model: t, header: header, byName: make(map[string][]int)}
+	if err := dec.indexFields(t, nil); err != nil {
+		return nil, err
+	}
+	dec.fields = make([][]int, len(header))
+	for i, column := range header {
+		dec.fields[i] = dec.byName[column]
+	}
+	return dec, nil
+}
+
+// indexFields walks the fields of t, embedded structs included
+func (dec *RowDecoder) indexFields(t reflect.Type, parent []int) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		index := append(append([]int{}, parent...), i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := dec.indexFields(field.Type, index); err != nil {
+				return err
+			}
+			continue
+		}
+
+		column := field.Tag.Get("column")
+		switch {
+		case column == "" || column == "-":
+		case column == extraColumns:
+			if field.Type != reflect.TypeOf(map[string]string{}) {
+				return fmt.Errorf("field %s tagged %q has to be a map[string]string", field.Name, extraColumns)
+			}
+			// the outermost map wins over those of the embedded structs
+			if dec.extra == nil || len(index) < len(dec.extra) {
+				dec.extra = index
+			}
+		default:
+			if previous, ok := dec.byName[column]; !ok || len(index) < len(previous) {
+				dec.byName[column] = index
+			}
+		}
+	}
+	return nil
+}
+
+// Model returns the type the rows are decoded into
+func (dec *RowDecoder) Model() reflect.Type {
+	return dec.model
+}
+
+// Decode sets the fields of dst, a pointer to the model, from the columns of a row
+func (dec *RowDecoder) Decode(fields []string, dst interface{}) error {
+	v, err := dec.target(dst)
+	if err != nil {
+		return err
+	}
+	if len(fields) != len(dec.header) {
+		return fmt.Errorf("%d columns instead of %d", len(fields), len(dec.header))
+	}
+	for i, value := range fields {
+		if err := dec.set(v, dec.fields[i], dec.header[i], value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeObject sets the fields of dst, a pointer to the model, from a JSON object. Nested
+// objects and arrays are kept as JSON.
+func (dec *RowDecoder) DecodeObject(object map[string]interface{}, dst interface{}) error {
+	v, err := dec.target(dst)
+	if err != nil {
+		return err
+	}
+	for column, raw := range object {
+		value, err := jsonString(raw)
+		if err != nil {
+			return fmt.Errorf("column %q: %v", column, err)
+		}
+		if err := dec.set(v, dec.byName[column], column, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dec *RowDecoder) target(dst interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Type() != dec.model {
+		return reflect.Value{}, fmt.Errorf("rows have to be decoded into a *%v, not %T", dec.model, dst)
+	}
+	return v.Elem(), nil
+}
+
+// set converts the value of a column to the type of its field, or keeps it in the
+// extra columns when it has no field
+func (dec *RowDecoder) set(v reflect.Value, index []int, column, value string) error {
+	if index == nil {
+		if dec.extra != nil {
+			extra := v.FieldByIndex(dec.extra)
+			if extra.IsNil() {
+				extra.Set(reflect.MakeMap(extra.Type()))
+			}
+			extra.SetMapIndex(reflect.ValueOf(column), reflect.ValueOf(value))
+		}
+		return nil
+	}
+
+	field := v.FieldByIndex(index)
+	if err := setField(field, strings.TrimSpace(value)); err != nil {
+		return fmt.Errorf("column %q: %v", column, err)
+	}
+	return nil
+}
+
+// setField converts a value to the type of the field, an empty value is the zero value
+func setField(field reflect.Value, value string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	if value == "" {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid positive integer %q", value)
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetFloat(n)
+	case reflect.Bool:
+		switch strings.ToLower(value) {
+		case "1", "true", "yes", "y":
+			field.SetBool(true)
+		case "0", "false", "no", "n":
+			field.SetBool(false)
+		default:
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+	default:
+		return fmt.Errorf("unsupported field type %v", field.Type())
+	}
+	return nil
+}
+
+// jsonString returns the text of a decoded JSON value, as it would appear in a TSV column
+func jsonString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	}
+}
+
+// collectRow decodes a row written to the output into the batch of the current chunk,
+// a row that doesn't fit the model is left out of the batch as an anomaly
+func (d *Downloader) collectRow(row []byte) error {
+	if d.OnBatch == nil {
+		return nil
+	}
+	if d.decoder == nil {
+		decoder, err := NewRowDecoder(strings.Split(d.Header, "\t"), rowModel(d.client.Mode, d.client.Deep))
+		if err != nil {
+			return &projectionError{err}
+		}
+		d.decoder = decoder
+		d.batch = reflect.MakeSlice(reflect.SliceOf(decoder.Model()), 0, 0)
+	}
+
+	value := reflect.New(d.decoder.Model())
+	if err := d.decoder.Decode(strings.Split(string(row), "\t"), value.Interface()); err != nil {
+		return d.recordAnomaly(AnomalyType, fmt.Sprintf("row %d was left out of the batch, %v",
+			d.CurrentTarget.DoneElements, err))
+	}
+	d.batch = reflect.Append(d.batch, value.Elem())
+	return nil
+}
+
+// deliverBatch hands the decoded rows of the chunk to OnBatch
+func (d *Downloader) deliverBatch() error {
+	if d.OnBatch == nil || !d.batch.IsValid() || d.batch.Len() == 0 {
+		return nil
+	}
+	batch := d.batch.Interface()
+	d.batch = reflect.MakeSlice(d.batch.Type(), 0, 0)
+	if err := d.OnBatch(batch); err != nil {
+		return fmt.Errorf("Batch handler failed: %v", err)
+	}
+	return nil
+}
@@ -1,31 +1,34 @@
 package downloader
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
-	"strconv"
-	"strings"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	// SMOOTHINGFACTOR -
-	SMOOTHINGFACTOR = 0.005
+	// SMOOTHINGFACTOR the weight of the latest chunk in the throughput averages the ETA
+	// is estimated from
+	SMOOTHINGFACTOR = 0.2
 	resumerSuffix   = ".audisto_"
 
 	// SelfTargetSuffix used when --targets=self, the output filename will be appended this suffix
 	SelfTargetSuffix = "_links"
+
+	// StdoutFilename the output filename that makes the downloader write rows to stdout
+	StdoutFilename = "-"
 )
 
 var (
-	debugging    = false // if true, debug messages will be shown
-	outputWriter *bufio.Writer
+	debugging = false // if true, debug messages will be shown
 )
 
 func init() {
@@ -54,10 +57,110 @@ type Downloader struct {
 	TargetsFileNextID         int           `json:"targetsFileNextID"`
 	CurrentTarget             currentTarget `json:"currentTarget"`
 	PagesSelfTargetsCompleted bool          `json:"pagesSelfTargetsCompleted"`
+	Header                    string        `json:"header"`
+	Anomalies                 []Anomaly     `json:"anomalies,omitempty"`
+	Split                     *SplitState   `json:"split,omitempty"`
+	Upload                    *UploadState  `json:"upload,omitempty"`
+	// TargetElements the total elements of the targets, by page ID, once pre-scanned
+	TargetElements map[uint64]uint64 `json:"targetElements,omitempty"`
+	// CompletedTargets the targets downloaded but not appended to the output yet, by their
+	// index in the targets file, with their number of elements. TargetsFileNextID tells how
+	// many targets the output holds.
+	CompletedTargets map[int]uint64 `json:"completedTargets,omitempty"`
+	// ResolvedURLs the page IDs of the URLs of the targets file
+	ResolvedURLs map[string]uint64 `json:"resolvedURLs,omitempty"`
+	// Pipeline the progress of the pipeline this download is a stage of, kept in the same
+	// state file
+	Pipeline *PipelineState `json:"pipeline,omitempty"`
+
+	// Format the chunks are requested in, FormatTSV (default) or FormatJSON
+	Format string `json:"format,omitempty"`
+	// Columns if set, only these columns (by header name) are written to the output
+	Columns []string `json:"columns,omitempty"`
+	// Where if set, only the rows matching this expression are written to the output,
+	// see ParseExpression. Discarded rows are still counted in DoneElements.
+	Where string `json:"where,omitempty"`
+	// RowOffset and RowLimit restrict the download to a range of the server rows,
+	// a limit of 0 means all of them
+	RowOffset uint64 `json:"rowOffset,omitempty"`
+	RowLimit  uint64 `json:"rowLimit,omitempty"`
+	// Sample if between 0 and 1, only this share of the rows, picked at random, is written
+	Sample float64 `json:"sample,omitempty"`
+	// SampleSeed picks the sampled rows, DefaultSampleSeed if not set
+	SampleSeed int64 `json:"sampleSeed,omitempty"`
+	// SampleChunks samples blocks of SampleBlockRows rows instead of single rows. Only
+	// the sampled blocks are downloaded.
+	SampleChunks bool `json:"sampleChunks,omitempty"`
+	// TargetColumn prepends the page ID of the target to every row, in a TargetColumnName
+	// column. It only applies to the targets of a targets file.
+	TargetColumn bool `json:"targetColumn,omitempty"`
+	// Outgoing downloads the links found on the targets instead of the links to them
+	Outgoing bool `json:"outgoing,omitempty"`
+	// OutputDir if set, the rows of every target are written to their own file in this
+	// directory, named after OutputTemplate. The output then lists the files of the targets.
+	OutputDir      string `json:"outputDir,omitempty"`
+	OutputTemplate string `json:"outputTemplate,omitempty"`
 
 	// Stop a switch to stop the current download
 	Stop bool
 
+	// MaxLineLength the maximum length in bytes of a single row, DefaultMaxLineLength if not set
+	MaxLineLength int `json:"-"`
+
+	// Strict makes the download fail on the first integrity anomaly instead of skipping it
+	Strict bool `json:"-"`
+
+	// DriftCheck what to do when chunk boundaries don't match: DriftWarn (default),
+	// DriftRedownload, DriftFail or DriftOff
+	DriftCheck string `json:"-"`
+	// DriftInterval the boundary of every DriftInterval-th chunk is checked with a request
+	// of its own when nothing overlaps, DefaultDriftInterval if not set
+	DriftInterval int `json:"-"`
+
+	// StateFilename an explicit path for the resume file. Resuming a download written
+	// to stdout is only possible with a state file.
+	StateFilename string `json:"-"`
+
+	// SplitRows and SplitSize rotate the output into part files once a part reaches
+	// that many rows or bytes, 0 means no limit
+	SplitRows uint64 `json:"-"`
+	SplitSize int64  `json:"-"`
+
+	// OutputType OutputTSV or OutputSQLite, guessed from the output extension if not set
+	OutputType string `json:"-"`
+
+	// Prescan asks the total elements of all the targets before downloading them, so the
+	// whole download has a row count. Empty targets are skipped.
+	Prescan bool `json:"-"`
+
+	// TargetsColumn if set, the page IDs (or URLs) of the targets are read from this column
+	// of the targets file, a CSV or TSV file with a header. The column is given by its name
+	// or its number, starting with 1.
+	TargetsColumn string `json:"-"`
+
+	// Incremental only appends the rows added since the previous download to its output,
+	// when the rows downloaded before did not change. The previous download is described
+	// by a file next to the output, see OutputMeta.
+	Incremental bool `json:"-"`
+
+	// TargetWorkers the number of targets downloaded at once, DefaultTargetWorkers if not
+	// set. Their rows are appended to the output in the order of the targets file.
+	TargetWorkers int `json:"-"`
+
+	// S3 if set, the output is uploaded to S3-compatible object storage instead of
+	// being written to a local file named after OutputFilename
+	S3 *S3Config `json:"-"`
+
+	// OnBatch if set, receives the rows of every chunk once they were written to the output,
+	// decoded into a []Page, []PageDetails, []Link or []LinkDetails depending on the mode and
+	// the details. The rows of the last chunk may be received again when resuming. An error
+	// stops the download.
+	OnBatch func(batch interface{}) error `json:"-"`
+
+	// Logger if set, receives the log messages and the events of the download, the
+	// credentials being redacted
+	Logger *Logger `json:"-"`
+
 	// Output filename can be change when the downloaded has more than one stage
 	// we keep the orginal filename here to be used in suffix/resume operations and checks
 	origOutputFilename     string
@@ -66,7 +169,23 @@ type Downloader struct {
 	currentTargetsMd5Hash  string
 	ids                    []uint64
 	totalIDsCount          int
-	elements               map[uint64]uint64 // [pageID] => totalElements
+	headerColumns          int
+	projection             []int // indexes of the selected columns in the header
+	where                  *Expression
+	decoder                *RowDecoder
+	batch                  reflect.Value // the decoded rows of the current chunk
+	// incremental the previous download, whose rows are checked before appending the new ones
+	incremental *OutputMeta
+	// droppedColumns the keys of the JSON rows missing from the header, see dropColumn
+	droppedColumns map[string]bool
+	// resumed the boundary of the first chunk after a resume is checked, see checkBoundary
+	resumed bool
+	// pages if set, only the rows of these pages are written, see Stage.From
+	pages      map[uint64]bool
+	pageColumn int
+
+	// Where the downloaded rows are written
+	out rowWriter
 
 	// Audisto API client
 	client *AudistoAPIClient
@@ -77,11 +196,32 @@ type Downloader struct {
 	// we’re only interested in its closed property (zero allocation).
 	done chan struct{}
 
-	// Store info/warning/debug messages as logs, without printing them these are
-	// opt-in, to be communicated through StatusReport channel.
+	// Info/warning/debug messages are handed to the observers, without printing them.
 	// No prints should happen mid-execution, prints are the responisibility of caller.
 	// errors are not logged, they halt the execution of this downloader and are always returned.
-	logs []map[LogType]string
+	observers []Observer
+	// started the download was started, so OnStart is only sent once across the stages
+	started bool
+	// receivedRows the rows received so far, to tell the bytes per row of the rate limit
+	receivedRows uint64
+	// speed the throughput of the download, for the ETA
+	speed throughput
+	// prescanned the total elements of all the targets are known
+	prescanned bool
+	// eventsMu hands the events of the target workers to the observers and OnBatch one at a time
+	eventsMu sync.Mutex
+	// parent the download a target worker works for, nil otherwise
+	parent *Downloader
+	// running the progress of the targets being downloaded by the workers, by index, and
+	// abort stops them after a failure. With workers, the progress of the download is only
+	// changed and read under workersMu.
+	workersMu sync.Mutex
+	running   map[int]currentTarget
+	abort     chan struct{}
+	// targetsSpool the copy of the targets read from stdin
+	targetsSpool string
+	// bufferDir holds the buffers of the targets when there is no resume file to put them next to
+	bufferDir string
 }
 
 // current download target.
@@ -89,6 +229,15 @@ type Downloader struct {
 type currentTarget struct {
 	DoneElements  uint64 `json:"doneElements"`
 	TotalElements uint64 `json:"totalElements"`
+	// Offset where the rows of this target begin in the output
+	Offset int64 `json:"offset"`
+	// LastRow the fingerprint of the last downloaded row
+	LastRow string `json:"lastRow,omitempty"`
+	// Fingerprints the fingerprints of the last downloaded chunks, see recordChunk
+	Fingerprints []ChunkFingerprint `json:"fingerprints,omitempty"`
+	// Skipped the rows of the blocks left out of the sample, counted in DoneElements
+	// without being downloaded, see skipUnsampled
+	Skipped uint64 `json:"skipped,omitempty"`
 }
 
 // New creates a new downloader
@@ -109,6 +258,10 @@ func New(reportProgress chan<- StatusReport) *Downloader {
 // when --targets=self AND the Pages API files is ALREADY downloaded, we auto-switch to:
 // output filaname + SelfTargetSuffix + resumerSuffix
 func (d *Downloader) getResumeFilename() string {
+	if d.StateFilename != "" {
+		return d.StateFilename
+	}
+
 	defaultPrefixFilename := d.origOutputFilename + resumerSuffix
 	if d.isInTargetsMode() {
 		// only --targets=self needs special handling
@@ -146,15 +299,27 @@ func (d *Downloader) getSelfOutputFilename() string {
 // tryResume check to see if the current download can be a resume of a previous one
 func (d *Downloader) tryResume(noDetails bool) (canBeResumed bool, err error) {
 
-	// Are we outputing to some file in the first place?
-	if d.OutputFilename == "" || d.noResume {
+	// Are we outputing to some file (or keeping a state file) in the first place?
+	if !d.canResume() || d.noResume {
 		return false, nil
 	}
 
-	resumeFileExists, outputFileExists := fExists(d.getResumeFilename()), fExists(d.OutputFilename)
+	// rows written to stdout are gone, the state file is all we have
+	if d.isStdout() {
+		if fExists(d.getResumeFilename()) != nil {
+			return false, nil
+		}
+		return d.loadResumeFile(noDetails)
+	}
+
+	resumeFileExists := fExists(d.getResumeFilename())
 
 	// check if we already have a complete download before?
-	if DownloadCompleted(d.OutputFilename, d.getResumeFilename()) {
+	if resumeFileExists != nil && d.outputExists() {
+		// an incremental download appends the rows added since
+		if d.Incremental {
+			return d.tryIncremental()
+		}
 		if d.currentTargetsFilename == "self" {
 			err = fmt.Errorf("%q file and its targets links file seem already downloaded: use no-resume to create a new", d.OutputFilename)
 		} else {
@@ -171,11 +336,17 @@ func (d *Downloader) tryResume(noDetails bool) (canBeResumed bool, err error) {
 
 	// If we have an UNFINISHED or FRESH download..
 	// Does the previous output file itself exist?
-	if outputFileExists != nil {
+	if !d.outputExists() {
 		err = fmt.Errorf("cannot resume; %q file does not exist: use --no-resume to create new", d.OutputFilename)
 		return false, err
 	}
 
+	return d.loadResumeFile(noDetails)
+}
+
+// loadResumeFile reads the resume file into the downloader and makes sure
+// it is consistent with the current download.
+func (d *Downloader) loadResumeFile(noDetails bool) (canBeResumed bool, err error) {
 	// So far, it looks like there is a resume file, lets try opening it
 	resumerFile, err := ioutil.ReadFile(d.getResumeFilename())
 	if err != nil {
@@ -183,11 +354,19 @@ func (d *Downloader) tryResume(noDetails bool) (canBeResumed bool, err error) {
 	}
 
 	// try to unmarshal the resumer file to the current downloader
+	selection := d.selection()
+	d.clearSelection()
 	err = json.Unmarshal(resumerFile, &d)
 	if err != nil {
 		return false, fmt.Errorf("resumer file error: %v", err)
 	}
 
+	// the rows already written were selected with the previous columns, condition and range
+	if previous := d.selection(); previous != selection {
+		err = fmt.Errorf("this file was begun with %s; continuing with %s will break the file", previous, selection)
+		return false, err
+	}
+
 	// Is there a conflict about whether or not details are to be downloaded
 	if d.NoDetails != noDetails {
 		err = fmt.Errorf("this file was begun with --no-details=%v; continuing with --no-details=%v will break the file", d.NoDetails, noDetails)
@@ -272,6 +451,21 @@ func (d *Downloader) tryResume(noDetails bool) (canBeResumed bool, err error) {
 	return true, nil
 }
 
+// isStdout check if rows are written to stdout rather than to a file
+func (d *Downloader) isStdout() bool {
+	return d.OutputFilename == "" || d.OutputFilename == StdoutFilename
+}
+
+// isSplit check if the output is split into part files
+func (d *Downloader) isSplit() bool {
+	return d.SplitRows > 0 || d.SplitSize > 0
+}
+
+// canResume check if there is a resume file to keep track of the progress
+func (d *Downloader) canResume() bool {
+	return !d.isStdout() || d.StateFilename != ""
+}
+
 func (d *Downloader) isDone() bool {
 	return d.CurrentTarget.DoneElements >= d.CurrentTarget.TotalElements
 }
@@ -304,8 +498,9 @@ func (d *Downloader) calculateTotalElements() error {
 	if err != nil {
 		return err
 	}
-	d.TotalElements = total
-	d.CurrentTarget.TotalElements = total
+	start, end := d.rowRange(total)
+	d.TotalElements = end - start
+	d.CurrentTarget.TotalElements = end
 
 	return nil
 }
@@ -316,28 +511,140 @@ func (d *Downloader) calculateTotalElementsForTargetPage(target uint64) (uint64,
 	return d.client.GetTotalElements()
 }
 
-// Setup assign params and execute the Run() function
+// Setup assign params and execute the Run() function. The settings that are not
+// parameters are taken from the fields of the downloader, see SetupOptions.
 func (d *Downloader) Setup(username string, password string, crawl uint64, mode string,
 	noDetails bool, chunknumber uint64, chunkSize uint64, output string,
 	filter string, noResume bool, order string, targets string) error {
 
-	var err error
+	o := d.options()
+	o.Username, o.Password, o.Crawl, o.Mode = username, password, crawl, mode
+	o.NoDetails, o.ChunkNumber, o.ChunkSize = noDetails, chunknumber, chunkSize
+	o.Output, o.Filter, o.NoResume, o.Order, o.Targets = output, filter, noResume, order, targets
+	return d.SetupOptions(o)
+}
+
+// NewWithOptions creates a downloader and sets it up with the given options, e.g.
+//
+//	d, err := downloader.NewWithOptions(progress,
+//		downloader.WithCredentials(username, password),
+//		downloader.WithCrawl(12345),
+//		downloader.WithOutput("myCrawl.tsv"))
+func NewWithOptions(reportProgress chan<- StatusReport, opts ...Option) (*Downloader, error) {
+	d := New(reportProgress)
+	return d, d.SetupOptions(NewOptions(opts...))
+}
+
+// options returns the settings held by the fields of the downloader
+func (d *Downloader) options() Options {
+	return Options{
+		MaxLineLength: d.MaxLineLength,
+		Strict:        d.Strict,
+		DriftCheck:    d.DriftCheck,
+		DriftInterval: d.DriftInterval,
+		StateFile:     d.StateFilename,
+		SplitRows:     d.SplitRows,
+		SplitSize:     d.SplitSize,
+		OutputType:    d.OutputType,
+		S3:            d.S3,
+		Format:        d.Format,
+		Columns:       d.Columns,
+		Where:         d.Where,
+		Offset:        d.RowOffset,
+		Limit:         d.RowLimit,
+		Sample:        d.Sample,
+		SampleSeed:    d.SampleSeed,
+		SampleChunks:  d.SampleChunks,
+		Prescan:       d.Prescan,
+		TargetWorkers: d.TargetWorkers,
+		TargetsColumn: d.TargetsColumn,
+		TargetColumn:  d.TargetColumn,
+		Outgoing:      d.Outgoing,
+		Incremental:   d.Incremental,
+		OutputDir:     d.OutputDir,
+
+		OutputTemplate: d.OutputTemplate,
+	}
+}
+
+// SetupOptions validates the options, applies them and prepares the download, resuming
+// a previous one when possible
+func (d *Downloader) SetupOptions(o Options) (err error) {
+	err = o.Validate()
+	if err != nil {
+		return err
+	}
+
+	d.MaxLineLength = o.MaxLineLength
+	d.Strict = o.Strict
+	d.DriftCheck = o.DriftCheck
+	d.DriftInterval = o.DriftInterval
+	d.StateFilename = o.StateFile
+	d.SplitRows, d.SplitSize = o.SplitRows, o.SplitSize
+	d.OutputType = o.OutputType
+	d.S3 = o.S3
+	d.Format = o.Format
+	d.Columns, d.Where = o.Columns, o.Where
+	d.RowOffset, d.RowLimit = o.Offset, o.Limit
+	d.Sample, d.SampleSeed, d.SampleChunks = o.Sample, o.SampleSeed, o.SampleChunks
+	d.Prescan = o.Prescan
+	d.TargetWorkers = o.TargetWorkers
+	d.TargetColumn = o.TargetColumn
+	d.Outgoing = o.Outgoing
+	d.Incremental = o.Incremental
+	d.OutputDir, d.OutputTemplate = o.OutputDir, o.OutputTemplate
+
+	// keep the secrets out of the logs
+	d.Logger.Redact(o.Password)
+	if o.S3 != nil {
+		d.Logger.Redact(o.S3.AccessKey, o.S3.SecretKey)
+	}
+	if o.Hooks != nil {
+		d.Logger.Redact(o.Hooks.Secret)
+	}
+
 	// init Audisto client to be used to interact with Audisto Rest API
-	d.client, err = NewClient(username, password, crawl, mode, noDetails, chunknumber,
-		chunkSize, filter, order)
+	d.client, err = NewClientOptions(o)
 
 	if err != nil { // does our client setup look good?
 		return err
 	}
+	d.client.Output = o.Format
 
 	// init downloader
-	d.OutputFilename = strings.TrimSpace(output)
-	d.origOutputFilename = strings.TrimSpace(output)
-	d.noResume = noResume
-	d.currentTargetsFilename = strings.TrimSpace(targets)
+	d.OutputFilename = o.Output
+	d.origOutputFilename = o.Output
+	d.noResume = o.NoResume
+	d.currentTargetsFilename = o.Targets
+	d.TargetsColumn = o.TargetsColumn
+	if d.currentTargetsFilename == StdinTargets {
+		if err = d.spoolTargets(); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				d.removeSpool()
+			}
+		}()
+	}
+
+	if err = d.validateOutput(); err != nil {
+		return err
+	}
+	if d.OutputDir != "" {
+		if err = os.MkdirAll(d.OutputDir, 0755); err != nil {
+			return err
+		}
+	}
+	if err = d.setupRows(); err != nil {
+		return err
+	}
+	if d.isStdout() && !d.canResume() {
+		d.appendLog(INFO, "Writing to stdout; resume is disabled unless a state file is set")
+	}
 
 	// can we resume a previous download?
-	isResumable, err := d.tryResume(noDetails)
+	isResumable, err := d.tryResume(o.NoDetails)
 
 	if !isResumable {
 		// is it because of an error ? if so, abort
@@ -347,29 +654,35 @@ func (d *Downloader) Setup(username string, password string, crawl uint64, mode
 
 		// no error, start a new download
 		d.appendLog(INFO, "No download to resume; starting a new...")
-
-		// create new outputFile
-		newFile, err := os.Create(d.OutputFilename)
-		if err != nil {
+	} else if d.Header != "" {
+		if err = d.prepareRows(); err != nil {
 			return err
 		}
-		outputWriter = bufio.NewWriter(newFile)
-	} else {
-		// open outputFile
-		existingFile, err := os.OpenFile(d.OutputFilename, os.O_WRONLY|os.O_APPEND, 0777)
-		if err != nil {
+	}
+
+	if d.out, err = d.openOutput(isResumable); err != nil {
+		return err
+	}
+	if isResumable {
+		if err = d.resumeFromOutput(); err != nil {
 			return err
 		}
-		outputWriter = bufio.NewWriter(existingFile)
+		// the rows of an incremental download are checked before appending the new ones
+		d.resumed = d.incremental == nil
 	}
 
 	// persist what we have for now for later resumes
-	return d.PersistConfig()
+	if err = d.PersistConfig(); err != nil {
+		return err
+	}
+	if o.Hooks != nil {
+		d.Subscribe(newNotifier(*o.Hooks, o, d.Logger))
+	}
+	return nil
 }
 
-func (d *Downloader) throttle(timeoutCount *int) {
-	*timeoutCount++
-	if *timeoutCount >= 3 {
+func (d *Downloader) throttle(timeoutCount *int64) {
+	if atomic.AddInt64(timeoutCount, 1) >= 3 {
 		// throttle
 		if (d.client.ChunkSize - 1000) > 0 {
 
@@ -382,7 +695,9 @@ func (d *Downloader) throttle(timeoutCount *int) {
 			}
 
 			// reset the timeout count
-			*timeoutCount = 0
+			atomic.StoreInt64(timeoutCount, 0)
+			d.logger().Info("chunk size lowered after server timeouts", "chunk_size", d.client.ChunkSize)
+			d.notify(func(o Observer) { o.OnThrottle(d.client.ChunkSize) })
 		}
 	}
 }
@@ -390,27 +705,42 @@ func (d *Downloader) throttle(timeoutCount *int) {
 // downloadTarget use the AudistoAPIClient to download a given target (link or page)
 func (d *Downloader) downloadTarget() error {
 
+	// number of consecutive chunks that were cut off before being completely read
+	var partialChunks int
+	// number of times the current chunk failed validation
+	var chunkRetries int
+	// number of times the target was downloaded again because the data shifted
+	var redownloads int
+	// number of consecutive requests answered with an error status
+	var statusRetries int
+
 	for !d.isDone() {
 
-		if d.Stop {
-			return fmt.Errorf("Downloader stopped")
+		if d.stopped() {
+			return ErrStopped
+		}
+
+		d.skipUnsampled()
+		if d.isDone() {
+			break
 		}
 
-		var processedLines int64
 		d.debugf("Calling next chunk")
-		var chunk []byte
+		var body io.ReadCloser
 		var statusCode int
 		var chunkStart uint64
 		var skip uint64
+		var requested time.Time
 		err := d.retry(5, 10, func() error {
 			var err error
-			chunk, statusCode, chunkStart, skip, err = d.nextChunk()
+			requested = time.Now()
+			body, statusCode, chunkStart, skip, err = d.nextChunk()
 			return err
 		})
 
 		if err != nil {
 			if err.Error() == "stopped" {
-				return fmt.Errorf("Downloader stopped")
+				return ErrStopped
 			}
 
 			d.debugf("Too many failures while calling next chunk; %v\n", err)
@@ -422,7 +752,11 @@ func (d *Downloader) downloadTarget() error {
 		// if statusCode is not 200, up by one the error count
 		// which is displayed in the progress bar
 		if statusCode != 200 {
-			errorCount++
+			atomic.AddInt64(&errorCount, 1)
+			statusRetries++
+			// we're not interested in the body of a failed request
+			body.Close()
+			d.chunkFetched(ChunkEvent{StatusCode: statusCode, Latency: time.Since(requested)})
 		}
 
 		// check status code
@@ -431,7 +765,7 @@ func (d *Downloader) downloadTarget() error {
 		case statusCode == 429:
 			{
 				// meaning: multiple requests
-				time.Sleep(time.Second * 30)
+				d.waitRetry(statusRetries, time.Second*30, fmt.Errorf("Too many requests (code %d)", statusCode))
 				continue
 			}
 		case statusCode >= 400 && statusCode < 500:
@@ -458,13 +792,13 @@ func (d *Downloader) downloadTarget() error {
 		case statusCode == 504:
 			{
 				d.throttle(&timeoutCount)
-				time.Sleep(time.Second * 30)
+				d.waitRetry(statusRetries, time.Second*30, fmt.Errorf("Server timeout (code %d)", statusCode))
 				continue
 			}
 		case statusCode >= 500 && statusCode < 600:
 			{
 				// meaning: server error
-				time.Sleep(time.Second * 30)
+				d.waitRetry(statusRetries, time.Second*30, fmt.Errorf("Server error (code %d)", statusCode))
 				continue
 			}
 		}
@@ -473,73 +807,254 @@ func (d *Downloader) downloadTarget() error {
 			// just in case it's not an error in the ranges above
 			continue
 		}
+		statusRetries = 0
 
-		// iterator for the received chunk
-		scanner := bufio.NewScanner(bytes.NewReader(chunk))
-		d.debugf("chunk bytes len: %v", len(chunk))
+		// stream the rows of the received chunk straight to the output
+		received := &countingReader{ReadCloser: body}
+		processedLines, readErr := d.processChunk(d.newRows(received), skip)
+		body.Close()
+		d.debugf("chunk rows processed: %v", processedLines)
+		d.chunkFetched(ChunkEvent{StatusCode: statusCode, Latency: time.Since(requested),
+			Bytes: received.n, Rows: processedLines, Err: readErr})
 
-		// write the header of the tsv only if it's the first/only target
-		if d.CurrentTarget.DoneElements == 0 {
-			scanner.Scan()
-			if d.DoneElements == 0 {
-				outputWriter.Write(append(scanner.Bytes(), []byte("\n")...))
+		// finalize every write
+		if err := d.out.flush(); err != nil {
+			return &writeError{err}
+		}
+		if err := d.deliverBatch(); err != nil {
+			return err
+		}
+		switch readErr.(type) {
+		case *writeError, *projectionError:
+			return readErr
+		}
+
+		if readErr == errDrift {
+			redownloads++
+			if redownloads > maxChunkRetries {
+				return fmt.Errorf("The data keeps shifting on the server, gave up after downloading it %d times", redownloads)
+			}
+			if err := d.restartTarget(); err != nil {
+				return err
 			}
+			continue
 		}
 
-		// skip lines that we alredy have
-		for i := uint64(0); i < skip; i++ {
-			scanner.Scan()
-			d.debugf("skipping this row: \n%s ", scanner.Text())
+		if _, ok := readErr.(*IntegrityError); ok {
+			d.PersistConfig()
+			return readErr
 		}
 
-		// iterate over the remaining lines
-		for scanner.Scan() {
-			// write lines (to stdout or file)
-			outputWriter.Write(append(scanner.Bytes(), []byte("\n")...))
+		switch readErr {
+		case nil:
+			partialChunks = 0
+			// A chunk was completely fetched, make sure it is not missing rows
+			expected, last := d.expectedRows(chunkStart, skip)
+			if processedLines < expected && !last {
+				msg := fmt.Sprintf("got %d rows instead of %d", skip+processedLines, skip+expected)
+				if err := d.rejectChunk(&chunkRetries, chunkStart, AnomalyRowCount, msg); err != nil {
+					d.PersistConfig()
+					return err
+				}
+			} else {
+				chunkRetries = 0
+			}
+			if processedLines > 0 {
+				d.recordChunk(chunkStart)
+			}
+		case errHeaderMismatch:
+			if err := d.rejectChunk(&chunkRetries, chunkStart, AnomalyHeader, readErr.Error()); err != nil {
+				d.PersistConfig()
+				return err
+			}
+		case ErrLineTooLong:
+			d.PersistConfig()
+			return fmt.Errorf("A row of chunk %d is longer than %d bytes; raise the maximum line length and resume download",
+				d.client.ChunkNumber, d.maxLineLength())
+		default:
+			// the connection dropped in the middle of the chunk: keep the rows we already
+			// have, the next request picks up the chunk where it was cut off.
+			atomic.AddInt64(&errorCount, 1)
+			partialChunks++
+			d.appendLog(WARNING, fmt.Sprintf("Chunk %d was cut off after %d rows (%v); requesting the rest\n",
+				d.client.ChunkNumber, processedLines, readErr))
+		}
 
-			// update the in-memory resumer
-			d.CurrentTarget.DoneElements++
-			d.DoneElements++
+		// save to file the resumer data (to be able to resume later)
+		d.PersistConfig()
+		d.debugf("downloader.DoneElements = %v", d.CurrentTarget.DoneElements)
 
-			// update the count of lines processed for this chunk
-			processedLines++
+		if partialChunks >= maxPartialChunks {
+			return fmt.Errorf("Network error; please check your connection to the internet and resume download")
 		}
+	}
+	return nil
+}
 
-		// finalize every write
-		outputWriter.Flush()
+// processChunk writes the rows of a chunk to the output while they are being received,
+// skipping the first `skip` rows which we already have. It returns the number of rows
+// received after the skipped ones, including those discarded by the validation.
+// An error other than io.EOF while reading means the chunk has been cut off, the rows
+// received so far are accounted for in DoneElements.
+func (d *Downloader) processChunk(rows chunkRows, skip uint64) (uint64, error) {
+	var processedLines uint64
+
+	// every chunk starts with the tsv header, it is only written once to the output
+	header, err := rows.next()
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := d.checkHeader(header); err != nil {
+		return 0, err
+	}
+
+	// skip lines that we alredy have, the last of them overlaps with what we downloaded last
+	var overlap []byte
+	for i := uint64(0); i < skip; i++ {
+		row, err := rows.next()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		d.debugf("skipping this row: \n%s ", row)
+		if i == skip-1 {
+			overlap = append(overlap, row...)
+		}
+	}
+
+	if err := d.checkBoundary(overlap, skip); err != nil {
+		return 0, err
+	}
+
+	// iterate over the remaining lines
+	var lastRow []byte
+	for {
+		row, err := rows.next()
+		if err != nil {
+			if processedLines > 0 {
+				d.CurrentTarget.LastRow = fingerprint(lastRow)
+			}
+			if err == io.EOF {
+				return processedLines, nil
+			}
+			return processedLines, err
+		}
 
-		scannerErr := scanner.Err()
-		if scannerErr == nil {
-			// A chunk was completely fetched. Since a chunk may miss lines, adjust resume counter
-			d.CurrentTarget.DoneElements = chunkStart + d.client.ChunkSize
+		valid := true
+		if columns := countColumns(row); columns != d.headerColumns {
+			position := d.CurrentTarget.DoneElements + 1
+			msg := fmt.Sprintf("row %d has %d columns instead of %d", position, columns, d.headerColumns)
+			if err := d.recordAnomaly(AnomalyColumns, msg); err != nil {
+				if processedLines > 0 {
+					d.CurrentTarget.LastRow = fingerprint(lastRow)
+				}
+				return processedLines, err
+			}
+			valid = false
 		}
 
-		// save to file the resumer data (to be able to resume later)
-		d.PersistConfig()
-		d.debugf("downloader.DoneElements = %v", d.CurrentTarget.DoneElements)
+		// write lines (to stdout or file)
+		written := false
+		if valid {
+			output, ok, err := d.transformRow(row, d.CurrentTarget.DoneElements)
+			if err != nil {
+				if processedLines > 0 {
+					d.CurrentTarget.LastRow = fingerprint(lastRow)
+				}
+				return processedLines, err
+			}
+			if ok {
+				if err := d.out.writeRow(output); err != nil {
+					return processedLines, &writeError{err}
+				}
+				written = true
+			}
+		}
+		lastRow = append(lastRow[:0], row...)
+
+		// update the in-memory resumer, server rows are counted even when discarded
+		d.CurrentTarget.DoneElements++
+		d.DoneElements++
 
-		// scanner error
-		if scannerErr != nil {
-			errorCount++
-			return fmt.Errorf("Error while scanning chunk: %s", err.Error())
+		// update the count of lines processed for this chunk
+		processedLines++
+
+		if written {
+			if err := d.collectRow(row); err != nil {
+				d.CurrentTarget.LastRow = fingerprint(lastRow)
+				return processedLines, err
+			}
 		}
+	}
+}
 
+// outputOffset returns the position in the output where the next row will be written
+func (d *Downloader) outputOffset() int64 {
+	if output, ok := d.out.(rewinder); ok {
+		return output.offset()
 	}
-	return nil
+	return 0
 }
 
-// Start runs the overall download logic after the initialization and validation steps
+func (d *Downloader) maxLineLength() int {
+	if d.MaxLineLength <= 0 {
+		return DefaultMaxLineLength
+	}
+	return d.MaxLineLength
+}
+
+// Start runs the overall download logic after the initialization and validation steps,
+// the observers are told how it ended
 func (d *Downloader) Start() error {
+	d.started = false
+	d.speed.start(time.Now())
+	if err := d.start(); err != nil {
+		// a download that can be resumed reads the targets from their copy again
+		if !d.canResume() {
+			d.removeSpool()
+		}
+		d.logger().Error("download failed", "output", d.OutputFilename, "done", d.DoneElements, "error", err)
+		d.notify(func(o Observer) { o.OnError(err) })
+		return err
+	}
+	report := d.ProgressReport()
+	d.logger().Info("download completed", "output", d.OutputFilename, "done", report.DoneElements,
+		"anomalies", len(report.Anomalies))
+	d.notify(func(o Observer) { o.OnComplete(report) })
+	return nil
+}
+
+// start downloads the target(s) of the current stage
+func (d *Downloader) start() error {
 	d.Stop = false
 	// ensure we have total elements to download
 	if !d.isInTargetsMode() || d.currentTargetsFilename == "self" {
-		d.calculateTotalElements()
+		err := d.calculateTotalElements()
 		d.appendLog(INFO, fmt.Sprintf("Total Elements: %d", d.TotalElements))
+		if d.incremental != nil {
+			// the rows of the previous download are only thrown away knowing the crawl
+			if err != nil {
+				return err
+			}
+			if err := d.checkIncrementalRows(); err != nil {
+				return err
+			}
+		}
 	} else if d.currentTargetsFilename != "self" {
 
 		if err := d.processTargetsFile(); err != nil {
 			return err
 		}
+		if d.Prescan {
+			if err := d.prescanTargets(); err != nil {
+				return err
+			}
+		}
 
 	}
 
@@ -553,14 +1068,21 @@ func (d *Downloader) Start() error {
 		go reportProgressStatus(d)
 	}
 
-	d.debug(d.client.Username, d.client.Password, d.client.CrawlID)
-	d.debugf("%#v\n", d)
+	if !d.started {
+		d.started = true
+		event := StartEvent{Crawl: d.client.CrawlID, Mode: d.client.Mode, Output: d.OutputFilename,
+			TotalElements: d.TotalElements, DoneElements: d.DoneElements, Targets: d.totalIDsCount}
+		d.logger().Info("download started", "output", event.Output, "total", event.TotalElements,
+			"done", event.DoneElements, "targets", event.Targets)
+		d.notify(func(o Observer) { o.OnStart(event) })
+	}
 
 	// var target currentTarget
 	var err error
 
-	// check if we're in targets mode. If so, we'll need to iterate over each target
-	// and download it separately. Update `TargetsFileNextID` to keep track of the overall progress.
+	// check if we're in targets mode. If so, we'll need to download each target separately,
+	// a few at once, see downloadTargets. `TargetsFileNextID` and `CompletedTargets` keep
+	// track of the overall progress.
 
 	// if targets mode is being set to 'self', we need first to download the file containing the links
 	// using the pages API then extract link IDs from it, and query the links API for each ID
@@ -570,26 +1092,8 @@ func (d *Downloader) Start() error {
 
 	if d.isInTargetsMode() {
 		if d.currentTargetsFilename != "self" {
-			for d.TargetsFileNextID < d.totalIDsCount && !d.Stop {
-				pageID := d.ids[d.TargetsFileNextID]
-				totalElements, err := d.calculateTotalElementsForTargetPage(pageID) // d.elements[pageID]
-				if err != nil {
-					return err
-				}
-
-				d.CurrentTarget.TotalElements = totalElements
-				d.CurrentTarget.DoneElements = 0
-
-				d.client.ResetChunkSize()
-				d.client.SetTargetPageFilter(pageID)
-				err = d.downloadTarget()
-				if err != nil {
-					return err
-				}
-
-				d.TargetsFileNextID++
-				// d.DoneElements += target.DoneElements
-				d.PersistConfig()
+			if err := d.downloadTargets(); err != nil {
+				return err
 			}
 		} else { // self mode, needs a special handling.
 			// check if the file containing link IDs has been downloaded using the pages API
@@ -602,10 +1106,8 @@ func (d *Downloader) Start() error {
 					d.appendLog(INFO, "Downloading the file from Pages API...")
 				}
 
-				d.CurrentTarget = currentTarget{
-					TotalElements: d.TotalElements,
-					DoneElements:  d.DoneElements,
-				}
+				d.CurrentTarget.TotalElements = d.TotalElements
+				d.CurrentTarget.DoneElements = d.DoneElements
 				err = d.downloadTarget()
 				if err != nil {
 					return err
@@ -631,10 +1133,15 @@ func (d *Downloader) Start() error {
 				d.OutputFilename = d.getSelfOutputFilename()
 				d.TotalElements = 0
 				d.DoneElements = 0
+				// the pages are the targets of the links stage
+				d.TargetElements = nil
+				d.prescanned = false
+				// the links file comes with its own header
+				d.Header = ""
+				d.headerColumns = 0
 				// reset elements calculation for the new progress report,
 				// and since we're going to recalculate the elements for the next stage
-				d.CurrentTarget.TotalElements = 0
-				d.CurrentTarget.DoneElements = 0
+				d.CurrentTarget = currentTarget{}
 				d.client.ResetChunkSize()
 				d.PersistConfig()
 
@@ -644,26 +1151,37 @@ func (d *Downloader) Start() error {
 				// Switch the client mode from pages to links
 				d.client.Mode = "links"
 				// create the new outputFile
-				newFile, err := os.Create(d.OutputFilename)
-				if err != nil {
+				if err := d.out.close(); err != nil {
+					return err
+				}
+				if d.out, err = d.openOutput(false); err != nil {
 					return err
 				}
-				outputWriter = bufio.NewWriter(newFile)
-				return d.Start() // recursive call to execute the targets stage
+				stage := StageEvent{From: "pages", To: "links", Output: d.OutputFilename}
+				d.logger().Info("stage changed", "from", stage.From, "to", stage.To, "output", stage.Output)
+				d.notify(func(o Observer) { o.OnStageChange(stage) })
+				return d.start() // recursive call to execute the targets stage
 
 			}
 		}
 	} else {
-		d.CurrentTarget = currentTarget{
-			TotalElements: d.TotalElements,
-			DoneElements:  d.DoneElements,
-		}
+		// the positions of the current target are the ones of the server rows
+		d.CurrentTarget.TotalElements = d.RowOffset + d.TotalElements
+		d.CurrentTarget.DoneElements = d.RowOffset + d.DoneElements
 		err = d.downloadTarget()
 		if err != nil {
 			return err
 		}
 	}
 
+	if err := d.out.close(); err != nil {
+		return err
+	}
+
+	if summary := d.AnomaliesSummary(); summary != "" {
+		d.appendLog(WARNING, summary+"\n")
+	}
+
 	// close the StatusReport channel if it exists
 	// do not make this a defer, or move this to the top
 	// we have a recursive call of this function when we're in 'targets' mode,
@@ -673,6 +1191,12 @@ func (d *Downloader) Start() error {
 		close(d.done)
 	}
 
+	d.removeSpool()
+	if d.Incremental {
+		if err := d.writeOutputMeta(); err != nil {
+			return err
+		}
+	}
 	return d.deleteResumerFile()
 }
 
@@ -722,24 +1246,21 @@ func (d *Downloader) nextChunkNumber() (nextChunkNumber, skipNRows uint64) {
 	return
 }
 
-// nextChunk configures the API request and returns the chunk
-func (d *Downloader) nextChunk() ([]byte, int, uint64, uint64, error) {
+// nextChunk configures the API request and returns the chunk as a stream.
+// The caller is responsible for closing it.
+func (d *Downloader) nextChunk() (io.ReadCloser, int, uint64, uint64, error) {
 
 	nextChunkNumber, skipNRows := d.nextChunkNumber()
 	chunkStartNumber := nextChunkNumber * d.client.ChunkSize
 
-	if d.CurrentTarget.DoneElements > 0 {
-		skipNRows++
-	}
-
-	if debugging {
+	if debugging || d.Logger.Enabled(DEBUG) {
 		url, _ := d.client.GetRequestURL()
 		d.debugf("request url: %s", url.String())
 	}
 
-	body, statusCode, err := d.client.FetchRawChunk(false)
+	body, statusCode, err := d.client.FetchChunk(false)
 	if err != nil {
-		return []byte(""), 0, 0, 0, err
+		return nil, 0, 0, 0, err
 	}
 
 	return body, statusCode, chunkStartNumber, skipNRows, nil
@@ -747,8 +1268,13 @@ func (d *Downloader) nextChunk() ([]byte, int, uint64, uint64, error) {
 
 // PersistConfig saves the resumer to file
 func (d *Downloader) PersistConfig() error {
-	// save config to file only if not printing to stdout
-	if d.OutputFilename == "" {
+	// the target workers are persisted by their parent, which follows their progress
+	if d.parent != nil {
+		d.parent.followTarget(d.TargetsFileNextID, d.CurrentTarget)
+		return nil
+	}
+	// save config to file only if not printing to stdout, or with an explicit state file.
+	if !d.canResume() {
 		return nil
 	}
 
@@ -779,7 +1305,7 @@ func (d *Downloader) PersistConfig() error {
 }
 
 func (d *Downloader) deleteResumerFile() error {
-	if d.OutputFilename != "" {
+	if d.canResume() {
 		d.debugf("removing %v", d.getResumeFilename())
 		return os.Remove(d.getResumeFilename())
 	}
@@ -787,99 +1313,35 @@ func (d *Downloader) deleteResumerFile() error {
 }
 
 func (d *Downloader) appendLog(logType LogType, message string) {
-	log := make(map[LogType]string)
-	log[logType] = message
-	d.logs = append(d.logs, log)
+	d.logger().Log(logType, message)
+	d.notify(func(o Observer) { o.OnLog(logType, message) })
+}
+
+// logger returns the Logger, adding the download to the fields of the entries
+func (d *Downloader) logger() *Logger {
+	if d.Logger == nil || d.client == nil {
+		return d.Logger
+	}
+	return d.Logger.With("crawl", d.client.CrawlID, "mode", d.client.Mode)
 }
 
 // a shortcut to retry with Downloader receiver
 func (d *Downloader) retry(attempts int, sleep int, callback func() error) (err error) {
-	if d.Stop {
+	if d.stopped() {
 		return fmt.Errorf("stopped")
 	}
 	return retry(attempts, sleep, callback, d)
 }
 
-// processTargetFileLine Process file line according our validation rules:
-// If a line:
-// - Contains​ only​ digits,​ the​ ID​ is​ the​ line.
-// - Starts​ with​ digits​ followed​ by​ a comma,​ the​ ID​ is​ the​ number​ up​ to​ the​ comma.
-// - Starts​ with​ digits,​ followed​ by​ whitespace,​ the​ ID​ is​ the​ number​ up​ the​ the whitespace.
-// - Does​ not​ start​ with​ a digit,​ it​ is​ ignored.​ A line​ is​ outputted​ stating​ “Line number​ {x}​ was​ ignored”,​ where​ {x}​ is​ the​ number​ of​ the​ current​ line​ (starting​ with​ 1).
-// - Does​ start​ with​ digits​ followed​ by​ anything​ but​ whitespace​ or​ a comma,​ it​ is ignored.
-func (d *Downloader) processTargetFileLine(line string, lineNumber uint) (valid bool, id uint64) {
-
-	// split the line by whitespaces, tabs if any... using string.Fields
-	// this would also respect: if a line contains​ only​ digits, the ID is the line
-	// because it's a whole string of digits, well get an array of length 1 and we'll continue processing
-	fields := strings.Fields(line)
-	if len(fields) < 1 {
-		d.appendLog(WARNING, fmt.Sprintf("Line number %d was ignored\n", lineNumber))
-		return false, 0
-	}
-
-	// remove quoting marks
-	relevantString := strings.Trim(fields[0], "\"")
-	relevantString = strings.Trim(relevantString, "'")
-
-	// Check the rule: if a line starts​ with​ digits​ followed​ by​ a comma,​ the​ ID​ is​ the​ number​ up​ to​ the​ comma.
-	if strings.Contains(relevantString, ",") {
-		relevantString = strings.Split(relevantString, ",")[0]
-	}
-
-	// Check the rules:
-	// - Does​ not​ start​ with​ a digit ..
-	// - Does​ start​ with​ digits​ followed​ by​ anything​ but​ whitespace​ or​ a comma
-	// Those can be checked at once. by tring to convert the string to a uint64
-	// since we already got rid of comma, whitespaces, ..etc
-	if value, err := strconv.ParseUint(relevantString, 10, 64); err == nil { // valid line
-		return true, value
-	}
-
-	d.appendLog(WARNING, fmt.Sprintf("Line number %d was ignored\n", lineNumber))
-	return false, 0
-}
-
+// debugf logs a DEBUG message, only shown by the observers when DD_DEBUG is set
 func (d *Downloader) debugf(format string, a ...interface{}) {
-	if debugging {
-		d.appendLog(WARNING, fmt.Sprintf(format, a))
+	if !debugging && !d.Logger.Enabled(DEBUG) {
+		return
 	}
-}
-
-func (d *Downloader) debug(a ...interface{}) {
+	// the credentials of the request URLs are never shown
+	message := RedactURL(fmt.Sprintf(format, a...))
+	d.logger().Debug(message)
 	if debugging {
-		d.appendLog(WARNING, fmt.Sprint(a))
+		d.notify(func(o Observer) { o.OnLog(DEBUG, message) })
 	}
 }
-
-// ProcessTargetFile extract links IDs from a given file
-func (d *Downloader) processTargetFile(filePath string) (ids []uint64, err error) {
-
-	file, err := os.Open(filePath)
-	defer file.Close()
-
-	if err != nil {
-		return ids, err
-	}
-
-	scanner := bufio.NewScanner(file)
-	var lineNumber uint = 1 // line numbers start with 1 NOT 0
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		valid, id := d.processTargetFileLine(line, lineNumber)
-
-		lineNumber++ // increment line number first, no matter what
-		if !valid {
-			continue
-		}
-
-		ids = append(ids, id)
-	}
-
-	if len(ids) < 1 {
-		return ids, fmt.Errorf("targets file does not contain any valid page ID")
-	}
-
-	return ids, nil
-}
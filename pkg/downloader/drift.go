@@ -0,0 +1,217 @@
+package downloader
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// What to do when the data shifted on the server between two chunks
+const (
+	// DriftWarn record an anomaly and carry on (default)
+	DriftWarn = "warn"
+	// DriftRedownload throw away what was downloaded for the current target and start it over
+	DriftRedownload = "redownload"
+	// DriftFail abort the download
+	DriftFail = "fail"
+	// DriftOff do not check chunk boundaries at all
+	DriftOff = "off"
+)
+
+// AnomalyDrift the row preceding a chunk is not the one downloaded last
+const AnomalyDrift AnomalyKind = "drift"
+
+const (
+	// DefaultDriftInterval every how many chunks the boundary is checked when nothing
+	// overlaps with the rows downloaded before, see Downloader.DriftInterval
+	DefaultDriftInterval = 10
+
+	// maxFingerprints the number of chunk fingerprints kept in the resume file
+	maxFingerprints = 100
+)
+
+// errDrift is returned by processChunk when the current target has to be downloaded again
+var errDrift = errors.New("the data shifted on the server")
+
+// ChunkFingerprint identifies the content of a downloaded chunk, so a later run can
+// tell whether it is still looking at the same data.
+type ChunkFingerprint struct {
+	Start   uint64 `json:"start"`
+	Rows    uint64 `json:"rows"`
+	LastRow string `json:"lastRow"`
+}
+
+// ValidDriftCheck checks the value of a drift check mode
+func ValidDriftCheck(mode string) bool {
+	switch mode {
+	case "", DriftWarn, DriftRedownload, DriftFail, DriftOff:
+		return true
+	}
+	return false
+}
+
+func fingerprint(row []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(row))
+}
+
+func (d *Downloader) driftCheck() string {
+	if d.DriftCheck == "" {
+		return DriftWarn
+	}
+	return d.DriftCheck
+}
+
+func (d *Downloader) driftInterval() uint64 {
+	if d.DriftInterval <= 0 {
+		return DefaultDriftInterval
+	}
+	return uint64(d.DriftInterval)
+}
+
+// checkBoundary makes sure the row preceding the rows about to be written is the last
+// row we downloaded, otherwise the data or its ordering changed on the server since.
+// overlap is the last of the skipped rows of the chunk. When nothing was skipped, that
+// row is requested on its own for the first chunk after a resume and for every
+// DriftInterval-th chunk: doing so for every chunk would double the requests.
+func (d *Downloader) checkBoundary(overlap []byte, skipped uint64) error {
+	resumed := d.resumed
+	d.resumed = false
+	if d.driftCheck() == DriftOff || d.CurrentTarget.DoneElements == 0 || d.CurrentTarget.LastRow == "" {
+		return nil
+	}
+
+	if skipped == 0 {
+		if !resumed && d.client.ChunkNumber%d.driftInterval() != 0 {
+			return nil
+		}
+		row, err := d.fetchRow(d.CurrentTarget.DoneElements - 1)
+		if err != nil {
+			d.appendLog(WARNING, fmt.Sprintf("Could not check the boundary of chunk %d: %v\n", d.client.ChunkNumber, err))
+			return nil
+		}
+		overlap = row
+	}
+
+	if fingerprint(overlap) == d.CurrentTarget.LastRow {
+		return nil
+	}
+
+	msg := fmt.Sprintf("row %d changed since it was downloaded, the data shifted on the server", d.CurrentTarget.DoneElements)
+	switch d.driftCheck() {
+	case DriftRedownload:
+		d.appendLog(WARNING, fmt.Sprintf("Chunk %d: %s\n", d.client.ChunkNumber, msg))
+		return errDrift
+	case DriftFail:
+		return &IntegrityError{Anomaly: d.newAnomaly(AnomalyDrift, msg)}
+	default:
+		return d.recordAnomaly(AnomalyDrift, msg)
+	}
+}
+
+// fetchRow requests the single row at the given (zero-based) position of the current target,
+// the request is retried and reported to the observers like the ones of the chunks
+func (d *Downloader) fetchRow(position uint64) ([]byte, error) {
+	chunkNumber, chunkSize := d.client.ChunkNumber, d.client.ChunkSize
+	defer func() {
+		d.client.ChunkNumber, d.client.ChunkSize = chunkNumber, chunkSize
+	}()
+	d.client.ChunkNumber, d.client.ChunkSize = position, 1
+
+	var row []byte
+	err := d.retry(5, 10, func() error {
+		requested := time.Now()
+		body, statusCode, err := d.client.FetchChunk(false)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		received := &countingReader{ReadCloser: body}
+		if statusCode == 200 {
+			row, err = readRow(d.newRows(received))
+		} else {
+			err = fmt.Errorf("unexpected status code %d", statusCode)
+		}
+		d.chunkFetched(ChunkEvent{StatusCode: statusCode, Latency: time.Since(requested), Bytes: received.n, Err: err})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return nil, fmt.Errorf("row %d does not exist anymore", position+1)
+	}
+	return row, nil
+}
+
+// readRow returns the first row following the header, nil if there is none
+func readRow(rows chunkRows) ([]byte, error) {
+	if _, err := rows.next(); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	row, err := rows.next()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return row, err
+}
+
+// recordChunk records the fingerprint of the chunk starting at `start` once it is downloaded,
+// the last maxFingerprints ones are kept
+func (d *Downloader) recordChunk(start uint64) {
+	fp := ChunkFingerprint{
+		Start:   start,
+		Rows:    d.CurrentTarget.DoneElements - start,
+		LastRow: d.CurrentTarget.LastRow,
+	}
+
+	fingerprints := d.CurrentTarget.Fingerprints
+	// a chunk requested more than once replaces its previous fingerprint
+	if n := len(fingerprints); n > 0 && fingerprints[n-1].Start == start {
+		fingerprints[n-1] = fp
+		return
+	}
+	if len(fingerprints) == maxFingerprints {
+		fingerprints = append(fingerprints[:0], fingerprints[1:]...)
+	}
+	d.CurrentTarget.Fingerprints = append(fingerprints, fp)
+}
+
+// lastChunk returns the fingerprint of the last downloaded chunk of the current target,
+// nil if there is none
+func (d *Downloader) lastChunk() *ChunkFingerprint {
+	if n := len(d.CurrentTarget.Fingerprints); n > 0 {
+		return &d.CurrentTarget.Fingerprints[n-1]
+	}
+	return nil
+}
+
+// restartTarget throws away what was downloaded for the current target and starts it over
+func (d *Downloader) restartTarget() error {
+	output, ok := d.out.(rewinder)
+	if !ok {
+		return fmt.Errorf("the data shifted on the server, and this output can't be downloaded again")
+	}
+	if err := output.rewind(d.CurrentTarget.Offset); err != nil {
+		return err
+	}
+
+	d.DoneElements -= d.CurrentTarget.DoneElements - d.RowOffset
+	if d.CurrentTarget.Offset == 0 {
+		// the header went away with the rows
+		d.Header = ""
+		d.headerColumns = 0
+	}
+
+	d.CurrentTarget = currentTarget{
+		DoneElements:  d.RowOffset,
+		TotalElements: d.CurrentTarget.TotalElements,
+		Offset:        d.CurrentTarget.Offset,
+	}
+	return d.PersistConfig()
+}
@@ -1,5 +1,10 @@
 package downloader
 
+import "errors"
+
+// ErrStopped is returned by Start when the download was stopped by setting Stop
+var ErrStopped = errors.New("Downloader stopped")
+
 // StatusCodesErrors ..
 var StatusCodesErrors = map[int]string{
 	401: "Wrong credentials",
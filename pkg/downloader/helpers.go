@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,6 +40,7 @@ func getFileMD5Hash(filepath string) (string, error) {
 	if inerr != nil {
 		return "", inerr
 	}
+	defer infile.Close()
 
 	md5Hash := md5.New()
 	io.Copy(md5Hash, infile)
@@ -80,13 +82,14 @@ func retry(attempts int, sleep int, callback func() error, d *Downloader) (err e
 			break
 		}
 
-		errorCount++
+		atomic.AddInt64(&errorCount, 1)
 
 		// pause before retrying
-		time.Sleep(time.Duration(sleep) * time.Second)
-
 		if d != nil {
-			d.debug("Something failed, retrying;")
+			d.waitRetry(i+1, time.Duration(sleep)*time.Second, err)
+			d.debugf("Something failed, retrying;")
+		} else {
+			time.Sleep(time.Duration(sleep) * time.Second)
 		}
 	}
 	return fmt.Errorf("Abandoned after %d attempts, last error: %s", attempts, err)
@@ -0,0 +1,289 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events the hooks are notified of
+const (
+	// HookComplete the download completed
+	HookComplete = "complete"
+	// HookError the download stopped on an error
+	HookError = "error"
+)
+
+// Headers of the webhook requests
+const (
+	// WebhookEventHeader the event, HookComplete or HookError
+	WebhookEventHeader = "X-Data-Downloader-Event"
+	// WebhookSignatureHeader "sha256=" followed by the hex HMAC-SHA256 of the body, keyed
+	// with the secret, when one is set
+	WebhookSignatureHeader = "X-Data-Downloader-Signature"
+)
+
+const (
+	// webhookAttempts the number of times a webhook is called when it fails
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+)
+
+var (
+	// webhookRetryWait the pause between the attempts of a webhook
+	webhookRetryWait = 5 * time.Second
+	// webhookBudget the time the webhooks of an event are given altogether, so an
+	// endpoint that doesn't answer holds the end of the download back that long at most
+	webhookBudget = 20 * time.Second
+	// hookTimeout the time a command is given before it is killed
+	hookTimeout = 5 * time.Minute
+)
+
+// Hooks notify other systems once a download completed or failed: the webhooks are
+// posted a HookEvent as JSON, the commands are run by the shell with the event in
+// DD_* environment variables. A failing hook is logged, it doesn't change the outcome
+// of the download.
+type Hooks struct {
+	// Webhooks the URLs the events are posted to
+	Webhooks []string `json:"webhooks,omitempty" yaml:"webhooks,omitempty"`
+	// Secret if set, the webhook requests are signed with it, see WebhookSignatureHeader
+	Secret string `json:"secret,omitempty" yaml:"secret,omitempty"`
+	// OnComplete the command run once the download completed
+	OnComplete string `json:"onComplete,omitempty" yaml:"onComplete,omitempty"`
+	// OnError the command run when the download stopped on an error
+	OnError string `json:"onError,omitempty" yaml:"onError,omitempty"`
+}
+
+// HookEvent the payload of the webhooks
+type HookEvent struct {
+	Event  string `json:"event"`
+	Crawl  uint64 `json:"crawl"`
+	Mode   string `json:"mode"`
+	Output string `json:"output"`
+	// Rows the number of rows received by this run of the download
+	Rows uint64 `json:"rows"`
+	// Duration of this run of the download, in seconds
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+	Time     string  `json:"time"`
+}
+
+// validate checks the webhooks are HTTP URLs
+func (h *Hooks) validate() error {
+	var webhooks []string
+	for _, webhook := range h.Webhooks {
+		if webhook = strings.TrimSpace(webhook); webhook == "" {
+			continue
+		}
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("--webhook has to be an http(s) URL, not %q", RedactURL(webhook))
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	h.Webhooks = webhooks
+	h.OnComplete = strings.TrimSpace(h.OnComplete)
+	h.OnError = strings.TrimSpace(h.OnError)
+
+	if h.Secret != "" && len(h.Webhooks) == 0 {
+		return fmt.Errorf("--webhook-secret signs the webhooks, set --webhook as well")
+	}
+	return nil
+}
+
+// Signature returns the value of WebhookSignatureHeader for a body, so receivers can
+// check the requests
+func (h *Hooks) Signature(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifier observes a download to notify its hooks once it ended
+type notifier struct {
+	NopObserver
+	hooks   Hooks
+	logger  *Logger
+	client  *http.Client
+	event   HookEvent
+	started time.Time
+}
+
+func newNotifier(hooks Hooks, o Options, logger *Logger) *notifier {
+	return &notifier{
+		hooks:  hooks,
+		logger: logger.With("crawl", o.Crawl, "mode", o.Mode),
+		client: &http.Client{Timeout: webhookTimeout},
+		event:  HookEvent{Crawl: o.Crawl, Mode: o.Mode, Output: o.Output},
+	}
+}
+
+// OnStart starts the clock of the run
+func (n *notifier) OnStart(event StartEvent) {
+	n.started = time.Now()
+	n.event.Rows = 0
+}
+
+// OnChunkFetched counts the rows received
+func (n *notifier) OnChunkFetched(event ChunkEvent) {
+	n.event.Rows += event.Rows
+}
+
+// OnStageChange follows the links of --targets=self to their own output
+func (n *notifier) OnStageChange(event StageEvent) {
+	n.event.Mode, n.event.Output = event.To, event.Output
+}
+
+// OnComplete notifies the hooks of the completed download
+func (n *notifier) OnComplete(report StatusReport) {
+	n.notify(HookComplete, nil, n.hooks.OnComplete)
+}
+
+// OnError notifies the hooks of the error the download stopped on
+func (n *notifier) OnError(err error) {
+	n.notify(HookError, err, n.hooks.OnError)
+}
+
+func (n *notifier) notify(name string, err error, command string) {
+	event := n.event
+	event.Event = name
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+	if !n.started.IsZero() {
+		event.Duration = time.Since(n.started).Seconds()
+	}
+	if err != nil {
+		event.Error = RedactURL(err.Error())
+	}
+
+	// the webhooks are posted at once
+	ctx, cancel := context.WithTimeout(context.Background(), webhookBudget)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, webhook := range n.hooks.Webhooks {
+		wg.Add(1)
+		go func(webhook string) {
+			defer wg.Done()
+			if err := n.post(ctx, webhook, event); err != nil {
+				n.logger.Warn("webhook failed", "webhook", webhookHost(webhook), "event", name, "error", err)
+			} else {
+				n.logger.Info("webhook notified", "webhook", webhookHost(webhook), "event", name)
+			}
+		}(webhook)
+	}
+	wg.Wait()
+	if command != "" {
+		if err := runHook(command, event); err != nil {
+			n.logger.Warn("hook command failed", "event", name, "error", err)
+		} else {
+			n.logger.Info("hook command run", "event", name)
+		}
+	}
+}
+
+// post sends the event to a webhook, trying again on network and server errors until
+// ctx is done
+func (n *notifier) post(ctx context.Context, webhook string, event HookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = n.postOnce(ctx, webhook, event.Event, body)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		if _, ok := err.(*webhookRejected); ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(webhookRetryWait):
+		}
+	}
+}
+
+// webhookRejected a webhook answered with a client error, asking again won't help
+type webhookRejected struct {
+	status int
+}
+
+func (e *webhookRejected) Error() string {
+	return fmt.Sprintf("rejected with status %d", e.status)
+}
+
+func (n *notifier) postOnce(ctx context.Context, webhook, name string, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, name)
+	if n.hooks.Secret != "" {
+		request.Header.Set(WebhookSignatureHeader, n.hooks.Signature(body))
+	}
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	switch {
+	case response.StatusCode >= 500:
+		return fmt.Errorf("failed with status %d", response.StatusCode)
+	case response.StatusCode >= 400:
+		return &webhookRejected{response.StatusCode}
+	}
+	return nil
+}
+
+// runHook runs a command with the shell, the event being passed as environment variables.
+// A command still running after hookTimeout is killed, along with what it started.
+func runHook(command string, event HookEvent) error {
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(),
+		"DD_EVENT="+event.Event,
+		fmt.Sprintf("DD_CRAWL=%d", event.Crawl),
+		"DD_MODE="+event.Mode,
+		"DD_OUTPUT="+event.Output,
+		fmt.Sprintf("DD_ROWS=%d", event.Rows),
+		fmt.Sprintf("DD_DURATION=%.0f", event.Duration),
+		"DD_ERROR="+event.Error,
+	)
+	// the output of the command goes to stderr, stdout may hold the rows
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(hookTimeout):
+		killCommand(cmd)
+		<-done
+		return fmt.Errorf("killed after %s", hookTimeout)
+	}
+}
+
+// webhookHost names a webhook in the logs, its path may hold a token
+func webhookHost(webhook string) string {
+	if u, err := url.Parse(webhook); err == nil {
+		return u.Host
+	}
+	return ""
+}
@@ -0,0 +1,20 @@
+// +build !windows
+
+package downloader
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand runs the command with sh, in its own process group
+func shellCommand(command string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// killCommand kills the shell and the processes it started
+func killCommand(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
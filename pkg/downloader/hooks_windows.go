@@ -0,0 +1,17 @@
+// +build windows
+
+package downloader
+
+import (
+	"os/exec"
+)
+
+// shellCommand runs the command with cmd
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
+
+// killCommand kills the shell, the processes it started are left running
+func killCommand(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,185 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// MetaSuffix the suffix of the file kept next to the output of an incremental download
+const MetaSuffix = ".audisto_meta"
+
+// OutputMeta describes a completed incremental download, so the next one can tell
+// whether it only has to append the rows added since
+type OutputMeta struct {
+	Crawl     uint64 `json:"crawl"`
+	Mode      string `json:"mode"`
+	Filter    string `json:"filter,omitempty"`
+	Order     string `json:"order,omitempty"`
+	NoDetails bool   `json:"noDetails"`
+	// Selection the rows and columns written, see Downloader.selection
+	Selection string `json:"selection"`
+	Header    string `json:"header,omitempty"`
+	// TotalElements the number of server rows downloaded
+	TotalElements uint64 `json:"totalElements"`
+	// LastChunk the fingerprint of the last downloaded chunk
+	LastChunk ChunkFingerprint `json:"lastChunk"`
+	// Size of the output once completed
+	Size      int64     `json:"size"`
+	Completed time.Time `json:"completed"`
+}
+
+// metaFilename returns the path of the metadata kept next to the output
+func (d *Downloader) metaFilename() string {
+	return d.OutputFilename + MetaSuffix
+}
+
+// tryIncremental checks whether the rows added since the previous download can be
+// appended to its output. The new rows come last only when the rows are not ordered
+// and the rows downloaded before did not change, otherwise everything is downloaded
+// again and the log tells why. The rows are checked once the download starts, see
+// checkIncrementalRows.
+func (d *Downloader) tryIncremental() (canBeResumed bool, err error) {
+	meta, reason, err := d.checkIncremental()
+	if err != nil {
+		return false, err
+	}
+	if reason != "" {
+		d.fallBack(reason)
+		return false, nil
+	}
+
+	d.incremental = meta
+	d.Header = meta.Header
+	d.DoneElements = meta.TotalElements
+	d.CurrentTarget = currentTarget{
+		DoneElements: meta.TotalElements,
+		LastRow:      meta.LastChunk.LastRow,
+		Fingerprints: []ChunkFingerprint{meta.LastChunk},
+	}
+	return true, nil
+}
+
+// checkIncremental compares the previous download with the current one, it returns why
+// the new rows can't be appended to the output, if they can't
+func (d *Downloader) checkIncremental() (meta *OutputMeta, reason string, err error) {
+	content, err := ioutil.ReadFile(d.metaFilename())
+	if os.IsNotExist(err) {
+		return nil, fmt.Sprintf("%s has no metadata of a previous incremental download", d.OutputFilename), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	meta = &OutputMeta{}
+	if err = json.Unmarshal(content, meta); err != nil {
+		return nil, "", fmt.Errorf("%s: %v", d.metaFilename(), err)
+	}
+
+	current := d.outputMeta()
+	switch {
+	case meta.Crawl != current.Crawl || meta.Mode != current.Mode || meta.Filter != current.Filter:
+		return nil, "the previous download was of another crawl, mode or filter", nil
+	case current.Order != "":
+		return nil, fmt.Sprintf("the rows are ordered by %q, the new ones may come anywhere", current.Order), nil
+	case meta.Order != "":
+		return nil, fmt.Sprintf("the previous download was ordered by %q", meta.Order), nil
+	case meta.NoDetails != current.NoDetails:
+		return nil, fmt.Sprintf("the previous download was made with --no-details=%v", meta.NoDetails), nil
+	case meta.Selection != current.Selection:
+		return nil, fmt.Sprintf("the previous download was made with %s", meta.Selection), nil
+	}
+
+	info, err := os.Stat(d.OutputFilename)
+	if err != nil {
+		return nil, "", err
+	}
+	if info.Size() != meta.Size {
+		return nil, fmt.Sprintf("%s changed since the previous download", d.OutputFilename), nil
+	}
+	return meta, "", nil
+}
+
+// checkIncrementalRows makes sure the rows of the previous download are still the first
+// ones of the crawl, otherwise the output is downloaded again from its beginning
+func (d *Downloader) checkIncrementalRows() error {
+	meta := d.incremental
+	d.incremental = nil
+
+	reason := ""
+	if d.TotalElements < meta.TotalElements {
+		reason = fmt.Sprintf("the crawl has %d rows, fewer than the %d downloaded before", d.TotalElements, meta.TotalElements)
+	} else if meta.TotalElements > 0 {
+		// the last row downloaded is still the same one at the same position, so are the rows before it
+		row, err := d.fetchRow(meta.TotalElements - 1)
+		if err != nil {
+			return fmt.Errorf("Could not check the rows of the previous download: %v", err)
+		}
+		if fingerprint(row) != meta.LastChunk.LastRow {
+			reason = fmt.Sprintf("row %d changed since the previous download, the rows shifted", meta.TotalElements)
+		}
+	}
+
+	if reason == "" {
+		d.appendLog(INFO, fmt.Sprintf("Downloading the %d rows added since the previous download of %s",
+			d.TotalElements-meta.TotalElements, meta.Completed.Format(time.RFC3339)))
+		return nil
+	}
+
+	d.fallBack(reason)
+	output, ok := d.out.(rewinder)
+	if !ok {
+		return fmt.Errorf("%s, and this output can't be downloaded again", reason)
+	}
+	if err := output.rewind(0); err != nil {
+		return err
+	}
+	d.Header = ""
+	d.headerColumns = 0
+	d.DoneElements = 0
+	d.CurrentTarget = currentTarget{}
+	return d.PersistConfig()
+}
+
+// fallBack tells why the whole output is downloaded again, its metadata only follows
+// once it is completed
+func (d *Downloader) fallBack(reason string) {
+	d.appendLog(WARNING, fmt.Sprintf("Downloading everything again: %s\n", reason))
+	os.Remove(d.metaFilename())
+}
+
+// outputMeta describes the download as it stands
+func (d *Downloader) outputMeta() OutputMeta {
+	meta := OutputMeta{
+		Crawl:         d.client.CrawlID,
+		Mode:          d.client.Mode,
+		Filter:        d.client.Filter,
+		Order:         d.client.Order,
+		NoDetails:     !d.client.Deep,
+		Selection:     d.selection(),
+		Header:        d.Header,
+		TotalElements: d.CurrentTarget.DoneElements,
+		Completed:     time.Now(),
+	}
+	if fp := d.lastChunk(); fp != nil {
+		meta.LastChunk = *fp
+	}
+	return meta
+}
+
+// writeOutputMeta keeps the metadata of the completed download next to the output
+func (d *Downloader) writeOutputMeta() error {
+	meta := d.outputMeta()
+	info, err := os.Stat(d.OutputFilename)
+	if err != nil {
+		return err
+	}
+	meta.Size = info.Size()
+
+	content, err := json.MarshalIndent(meta, "", "	")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.metaFilename(), content, 0644)
+}
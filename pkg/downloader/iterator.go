@@ -0,0 +1,333 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultRetryWait how long to wait before requesting a chunk again after the server
+// asked us to slow down or failed
+const DefaultRetryWait = 30 * time.Second
+
+// maxChunkAttempts the number of times a chunk is requested before giving up
+const maxChunkAttempts = 5
+
+// Query selects the rows of a crawl
+type Query struct {
+	Crawl uint64
+	// Mode "pages" (default) or "links"
+	Mode   string
+	Filter string
+	Order  string
+	// Deep requests the details of the pages or links
+	Deep bool
+}
+
+// Client gives access to the rows of Audisto crawls from Go code, without going
+// through the Downloader and its files.
+//
+//	client := downloader.NewRowsClient(username, password)
+//	rows := client.Rows(ctx, downloader.Query{Crawl: 12345, Deep: true})
+//	defer rows.Close()
+//	for rows.Next() {
+//		fmt.Println(rows.Row())
+//	}
+//	if err := rows.Err(); err != nil {
+//		...
+//	}
+type Client struct {
+	Username string
+	Password string
+	// ChunkSize the number of rows requested at once, DefaultChunkSize if not set
+	ChunkSize uint64
+	// RetryWait how long to wait before retrying, DefaultRetryWait if not set
+	RetryWait time.Duration
+	// Transport the http.RoundTripper the requests go through, http.DefaultTransport if not set
+	Transport http.RoundTripper
+}
+
+// NewRowsClient creates a Client with the given credentials
+func NewRowsClient(username, password string) *Client {
+	return &Client{Username: username, Password: password}
+}
+
+// Rows returns an iterator over the rows matching the query. The chunks are requested
+// as the rows are consumed; failed requests are retried and the chunk size is lowered
+// when the server times out.
+func (c *Client) Rows(ctx context.Context, query Query) *RowIterator {
+	it := &RowIterator{ctx: ctx, wait: c.RetryWait}
+	if it.wait <= 0 {
+		it.wait = DefaultRetryWait
+	}
+
+	mode := query.Mode
+	if mode == "" {
+		mode = "pages"
+	}
+	it.api, it.err = NewClient(c.Username, c.Password, query.Crawl, mode, !query.Deep, 0,
+		c.ChunkSize, query.Filter, query.Order)
+	if it.err == nil && c.Transport != nil {
+		it.api.httpClient.Transport = c.Transport
+	}
+	return it
+}
+
+// RowIterator iterates over the rows of a Query, see Client.Rows
+type RowIterator struct {
+	ctx  context.Context
+	api  *AudistoAPIClient
+	wait time.Duration
+
+	header []string
+	row    []string
+	err    error
+
+	total   uint64
+	started bool
+	// position the number of rows consumed so far
+	position uint64
+
+	body io.ReadCloser
+	rows *rowReader
+	// chunkStart the position of the first row read from the current chunk
+	chunkStart uint64
+	// failures consecutive failed attempts at the current chunk
+	failures int
+	// timeouts server timeouts since the chunk size was last lowered
+	timeouts int
+}
+
+// Next advances to the next row, it returns false once all rows were read or on error
+func (it *RowIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		if it.err = it.fetchTotal(); it.err != nil {
+			return false
+		}
+	}
+
+	for {
+		if it.err = it.ctx.Err(); it.err != nil {
+			it.closeChunk()
+			return false
+		}
+
+		if it.rows == nil {
+			if it.position >= it.total {
+				return false
+			}
+			if it.err = it.openChunk(); it.err != nil {
+				return false
+			}
+			continue
+		}
+
+		line, err := it.rows.next()
+		switch {
+		case err == nil:
+			it.row = strings.Split(string(line), "\t")
+			it.position++
+			it.failures = 0
+			return true
+		case err == io.EOF:
+			it.closeChunk()
+			if it.position == it.chunkStart {
+				// the crawl has less rows than announced
+				it.total = it.position
+				return false
+			}
+		case err == ErrLineTooLong:
+			it.closeChunk()
+			it.err = err
+			return false
+		default:
+			// cut off mid-chunk, the next request picks up after the last complete row
+			it.closeChunk()
+			if it.err = it.failed(fmt.Errorf("chunk cut off: %v", err)); it.err != nil {
+				return false
+			}
+		}
+	}
+}
+
+// Row returns the columns of the current row
+func (it *RowIterator) Row() []string {
+	return it.row
+}
+
+// Header returns the names of the columns, available after the first call to Next
+func (it *RowIterator) Header() []string {
+	return it.header
+}
+
+// Total returns the number of rows announced by the server, available after the first call to Next
+func (it *RowIterator) Total() uint64 {
+	return it.total
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *RowIterator) Err() error {
+	return it.err
+}
+
+// Close releases the connection of the chunk being read, when stopping before the end
+func (it *RowIterator) Close() error {
+	it.closeChunk()
+	return nil
+}
+
+// fetchTotal asks the number of rows, the failed requests being retried like the chunks
+func (it *RowIterator) fetchTotal() error {
+	for {
+		total, ok, err := it.requestTotal()
+		if err != nil {
+			return err
+		}
+		if ok {
+			it.total = total
+			it.failures = 0
+			return nil
+		}
+	}
+}
+
+// requestTotal requests the number of rows once, ok is false when it has to be asked again
+func (it *RowIterator) requestTotal() (total uint64, ok bool, err error) {
+	body, statusCode, err := it.api.FetchChunkContext(it.ctx, true)
+	if err != nil {
+		if it.ctx.Err() != nil {
+			return 0, false, it.ctx.Err()
+		}
+		return 0, false, it.failed(err)
+	}
+	defer body.Close()
+
+	switch {
+	case statusCode == 200:
+	case statusCode == 401 || statusCode == 403 || statusCode == 404:
+		return 0, false, errors.New(StatusCodesErrors[statusCode])
+	case statusCode == 429 || statusCode >= 500:
+		return 0, false, it.failed(fmt.Errorf("unexpected status code %d", statusCode))
+	default:
+		return 0, false, fmt.Errorf("Unknown error occurred (code %v)", statusCode)
+	}
+
+	var first chunk
+	if err := json.NewDecoder(body).Decode(&first); err != nil {
+		return 0, false, it.failed(err)
+	}
+	return first.Chunk.Total, true, nil
+}
+
+// openChunk requests the chunk holding the next row and skips the rows already consumed
+func (it *RowIterator) openChunk() error {
+	remaining := it.total - it.position
+	if remaining < it.api.ChunkSize {
+		it.api.SetChunkSize(remaining)
+	}
+	chunkNumber := it.position / it.api.ChunkSize
+	skip := it.position % it.api.ChunkSize
+	it.api.SetNextChunkNumber(chunkNumber)
+
+	body, statusCode, err := it.api.FetchChunkContext(it.ctx, false)
+	if err != nil {
+		if it.ctx.Err() != nil {
+			return it.ctx.Err()
+		}
+		return it.failed(err)
+	}
+
+	switch {
+	case statusCode == 200:
+	case statusCode == 401 || statusCode == 403 || statusCode == 404:
+		body.Close()
+		return errors.New(StatusCodesErrors[statusCode])
+	case statusCode == 504:
+		body.Close()
+		it.throttle()
+		return it.failed(fmt.Errorf("server timeout"))
+	case statusCode == 429 || statusCode >= 500:
+		body.Close()
+		return it.failed(fmt.Errorf("unexpected status code %d", statusCode))
+	default:
+		body.Close()
+		return fmt.Errorf("Unknown error occurred (code %v)", statusCode)
+	}
+
+	rows := newRowReader(body, DefaultMaxLineLength)
+	header, err := rows.next()
+	if err == io.EOF {
+		body.Close()
+		it.total = it.position
+		return nil
+	}
+	if err != nil {
+		body.Close()
+		return it.failed(err)
+	}
+	if it.header == nil {
+		it.header = strings.Split(string(header), "\t")
+	} else if string(header) != strings.Join(it.header, "\t") {
+		body.Close()
+		return fmt.Errorf("chunk %d: %v", chunkNumber, errHeaderMismatch)
+	}
+
+	for i := uint64(0); i < skip; i++ {
+		if _, err := rows.next(); err != nil {
+			body.Close()
+			if err == io.EOF {
+				// the crawl has less rows than announced
+				it.total = it.position
+				return nil
+			}
+			return it.failed(err)
+		}
+	}
+
+	it.body, it.rows = body, rows
+	it.chunkStart = it.position
+	return nil
+}
+
+func (it *RowIterator) closeChunk() {
+	if it.body != nil {
+		it.body.Close()
+	}
+	it.body, it.rows = nil, nil
+}
+
+// failed waits before the next attempt, or gives up after too many of them
+func (it *RowIterator) failed(err error) error {
+	it.failures++
+	if it.failures >= maxChunkAttempts {
+		return fmt.Errorf("Abandoned after %d attempts, last error: %v", it.failures, err)
+	}
+	select {
+	case <-it.ctx.Done():
+		return it.ctx.Err()
+	case <-time.After(it.wait):
+		return nil
+	}
+}
+
+// throttle lowers the chunk size after repeated server timeouts, like Downloader.throttle
+func (it *RowIterator) throttle() {
+	it.timeouts++
+	if it.timeouts >= 3 && it.api.ChunkSize > 1000 {
+		if it.api.ChunkSize == DefaultChunkSize {
+			it.api.ChunkSize -= 3000
+		} else {
+			it.api.ChunkSize -= 1000
+		}
+		it.timeouts = 0
+	}
+}
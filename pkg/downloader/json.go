@@ -0,0 +1,314 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Formats the chunks are requested in from the API
+const (
+	// FormatTSV the rows as tab separated values (default)
+	FormatTSV = DefaultOutputFormat
+	// FormatJSON the rows as JSON objects, converted to tab separated values by jsonRowReader
+	FormatJSON = "json"
+)
+
+// ValidFormat checks the format the chunks are requested in
+func ValidFormat(format string) bool {
+	return format == "" || format == FormatTSV || format == FormatJSON
+}
+
+// chunkRows the rows of a chunk, the header being the first one, see rowReader
+type chunkRows interface {
+	next() ([]byte, error)
+}
+
+// newRows reads the rows of a chunk in the format it was requested in
+func (d *Downloader) newRows(body io.Reader) chunkRows {
+	if d.client.Output == FormatJSON {
+		var header []string
+		if d.Header != "" {
+			header = strings.Split(d.Header, "\t")
+		}
+		rows := newJSONRowReader(body, d.MaxLineLength, header)
+		rows.onDropped = d.dropColumn
+		return rows
+	}
+	return newRowReader(body, d.MaxLineLength)
+}
+
+// dropColumn warns once about a key of the JSON rows that is not in the header
+func (d *Downloader) dropColumn(key string) {
+	if d.droppedColumns[key] {
+		return
+	}
+	if d.droppedColumns == nil {
+		d.droppedColumns = make(map[string]bool)
+	}
+	d.droppedColumns[key] = true
+	d.appendLog(WARNING, fmt.Sprintf("The rows have a %q key missing from the header, its values are left out\n", key))
+}
+
+// jsonRowReader streams the rows of a JSON chunk, the objects of its top-level array
+// (e.g. "pages"), as tab separated rows. Unless it is already known, the header is made
+// of the keys of all the objects of the chunk, in the order they appear, so a key left
+// out of the first objects still gets a column; that chunk is read entirely before its
+// rows are returned. The keys an object lacks get empty columns, the keys missing from
+// the header are left out. Strings are written as is, numbers and booleans as they
+// appear in the JSON, null as an empty column; nested objects and arrays are kept as
+// compact JSON, so they survive the conversion. Like rowReader, it only hands out
+// complete rows, so a chunk cut off mid-row is requested again from the last complete one.
+type jsonRowReader struct {
+	decoder   *json.Decoder
+	maxLength int
+	header    []string
+	// started the rows array was entered, done it was read entirely
+	started, done bool
+	// pending the rows read to build the header, returned on the next calls, followed by
+	// pendingErr, the error that stopped reading them
+	pending    [][]byte
+	pendingErr error
+	// onDropped if set, is told about the keys missing from the header
+	onDropped func(key string)
+	row       bytes.Buffer
+}
+
+func newJSONRowReader(r io.Reader, maxLength int, header []string) *jsonRowReader {
+	if maxLength <= 0 {
+		maxLength = DefaultMaxLineLength
+	}
+	return &jsonRowReader{decoder: json.NewDecoder(r), maxLength: maxLength, header: header}
+}
+
+// next returns the header first, then the rows, and io.EOF once the array was read
+func (r *jsonRowReader) next() ([]byte, error) {
+	if len(r.pending) > 0 {
+		row := r.pending[0]
+		r.pending = r.pending[1:]
+		return row, nil
+	}
+	if r.pendingErr != nil {
+		err := r.pendingErr
+		r.pendingErr = nil
+		return nil, err
+	}
+
+	if !r.started {
+		r.started = true
+		if err := r.findRows(); err != nil {
+			return nil, err
+		}
+		if r.header != nil {
+			return []byte(strings.Join(r.header, "\t")), nil
+		}
+		return r.readHeader()
+	}
+
+	keys, values, err := r.nextObject()
+	if err != nil {
+		return nil, err
+	}
+	return r.format(keys, values)
+}
+
+// readHeader reads the objects of the chunk to make the header of their keys, the rows
+// are kept until they are returned
+func (r *jsonRowReader) readHeader() ([]byte, error) {
+	type object struct {
+		keys   []string
+		values []json.RawMessage
+	}
+	var objects []object
+	for {
+		keys, values, err := r.nextObject()
+		if err != nil {
+			if err != io.EOF {
+				r.pendingErr = err
+			}
+			break
+		}
+		for _, key := range keys {
+			if indexOf(r.header, key) < 0 {
+				r.header = append(r.header, key)
+			}
+		}
+		objects = append(objects, object{keys, values})
+	}
+	if len(objects) == 0 {
+		// an empty chunk, or one cut off before its first row
+		err := r.pendingErr
+		r.pendingErr = nil
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+
+	for _, o := range objects {
+		row, err := r.format(o.keys, o.values)
+		if err != nil {
+			r.pendingErr = err
+			break
+		}
+		r.pending = append(r.pending, append([]byte(nil), row...))
+	}
+	return []byte(strings.Join(r.header, "\t")), nil
+}
+
+// findRows moves the decoder to the first element of the top-level array of the chunk
+func (r *jsonRowReader) findRows() error {
+	token, err := r.decoder.Token()
+	if err != nil {
+		// an empty chunk
+		return err
+	}
+	if token != json.Delim('{') {
+		return fmt.Errorf("unexpected %v in the JSON chunk, expected {", token)
+	}
+	for r.decoder.More() {
+		if _, err := r.decoder.Token(); err != nil { // the key
+			return unexpectedEOF(err)
+		}
+		token, err := r.decoder.Token()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if token == json.Delim('[') {
+			return nil
+		}
+		if err := r.skip(token); err != nil {
+			return err
+		}
+	}
+	// a chunk without rows
+	r.done = true
+	return nil
+}
+
+// nextObject returns the keys and the raw values of the next object of the rows array
+func (r *jsonRowReader) nextObject() ([]string, []json.RawMessage, error) {
+	if r.done || !r.decoder.More() {
+		r.done = true
+		return nil, nil, io.EOF
+	}
+	if err := r.expectDelim('{'); err != nil {
+		return nil, nil, err
+	}
+
+	var keys []string
+	var values []json.RawMessage
+	for r.decoder.More() {
+		token, err := r.decoder.Token()
+		if err != nil {
+			return nil, nil, unexpectedEOF(err)
+		}
+		key, _ := token.(string)
+		var value json.RawMessage
+		if err := r.decoder.Decode(&value); err != nil {
+			return nil, nil, unexpectedEOF(err)
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	if _, err := r.decoder.Token(); err != nil { // the closing brace
+		return nil, nil, unexpectedEOF(err)
+	}
+	return keys, values, nil
+}
+
+// format writes the values in the order of the header, leaving out the keys missing
+// from it
+func (r *jsonRowReader) format(keys []string, values []json.RawMessage) ([]byte, error) {
+	columns := make([]string, len(r.header))
+	for i, key := range keys {
+		index := indexOf(r.header, key)
+		if index < 0 {
+			if r.onDropped != nil {
+				r.onDropped(key)
+			}
+			continue
+		}
+		column, err := jsonColumn(values[i])
+		if err != nil {
+			return nil, err
+		}
+		columns[index] = column
+	}
+
+	r.row.Reset()
+	for i, column := range columns {
+		if i > 0 {
+			r.row.WriteByte('\t')
+		}
+		r.row.WriteString(column)
+	}
+	if r.row.Len() > r.maxLength {
+		return nil, ErrLineTooLong
+	}
+	return r.row.Bytes(), nil
+}
+
+func (r *jsonRowReader) expectDelim(delim json.Delim) error {
+	token, err := r.decoder.Token()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if token != delim {
+		return fmt.Errorf("unexpected %v in the JSON chunk, expected %v", token, delim)
+	}
+	return nil
+}
+
+// skip reads past the value beginning with token
+func (r *jsonRowReader) skip(token json.Token) error {
+	depth := 0
+	for {
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+		var err error
+		if token, err = r.decoder.Token(); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+}
+
+// jsonColumn returns the text of a JSON value as a tab separated column
+func jsonColumn(value json.RawMessage) (string, error) {
+	switch {
+	case len(value) == 0 || string(value) == "null":
+		return "", nil
+	case value[0] == '"':
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return "", err
+		}
+		// tabs and line breaks would split the column or the row
+		return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s), nil
+	case value[0] == '{' || value[0] == '[':
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, value); err != nil {
+			return "", err
+		}
+		return compact.String(), nil
+	default:
+		return string(value), nil
+	}
+}
+
+// unexpectedEOF tells a chunk cut off mid-row apart from one read completely
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
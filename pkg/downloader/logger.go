@@ -0,0 +1,343 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ERROR the level of the errors a download stopped on, only written to the Logger
+const ERROR LogType = "ERROR"
+
+// Formats of the log entries
+const (
+	// LogFormatText one line of key=value pairs per entry, as in logfmt (default)
+	LogFormatText = "text"
+	// LogFormatJSON one JSON object per entry
+	LogFormatJSON = "json"
+)
+
+// Rotation of the log files
+const (
+	// DefaultLogMaxSize the size a log file is rotated at
+	DefaultLogMaxSize = 10 * 1024 * 1024
+	// DefaultLogMaxBackups the number of rotated log files kept
+	DefaultLogMaxBackups = 3
+)
+
+// redacted replaces the secrets in the log entries
+const redacted = "***"
+
+var (
+	// logSeverity orders the levels, the entries below the level of the logger are dropped
+	logSeverity = map[LogType]int{DEBUG: 0, INFO: 1, WARNING: 2, ERROR: 3}
+	// urlCredentials the user:pass@ of an URL, as built by AudistoAPIClient.GetBaseURL
+	urlCredentials = regexp.MustCompile(`://[^/\s]*:[^/\s]*@`)
+	// secretKeys the fields whose values are never logged
+	secretKeys = []string{"password", "secret", "token", "authorization", "accesskey"}
+)
+
+// ParseLogLevel returns the level named by a --log-level value
+func ParseLogLevel(level string) (LogType, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return DEBUG, nil
+	case "", "info":
+		return INFO, nil
+	case "warn", "warning":
+		return WARNING, nil
+	case "error":
+		return ERROR, nil
+	}
+	return "", fmt.Errorf("--log-level has to be 'debug', 'info', 'warning' or 'error'")
+}
+
+// ValidLogFormat checks the format of the log entries
+func ValidLogFormat(format string) bool {
+	return format == "" || format == LogFormatText || format == LogFormatJSON
+}
+
+// RedactURL hides the credentials embedded in the URLs of a text
+func RedactURL(text string) string {
+	return urlCredentials.ReplaceAllString(text, "://"+redacted+":"+redacted+"@")
+}
+
+// Logger writes leveled entries made of a message and key-value fields, as text or JSON.
+// The credentials embedded in URLs, the values of the fields named like a password and
+// the secrets registered with Redact never make it to the output. A nil Logger discards
+// every entry, so it can be used without checking whether one was set.
+//
+//	logger := downloader.NewLogger(os.Stderr, downloader.INFO, downloader.LogFormatText)
+//	logger.Info("chunk fetched", "chunk", 3, "rows", 10000)
+type Logger struct {
+	*logSink
+	// fields added to every entry, see With
+	fields []interface{}
+}
+
+// logSink the output shared by a Logger and those derived from it
+type logSink struct {
+	mu      sync.Mutex
+	out     io.Writer
+	level   LogType
+	format  string
+	secrets []string
+}
+
+// NewLogger creates a logger writing the entries of level and above to out
+func NewLogger(out io.Writer, level LogType, format string) *Logger {
+	if _, ok := logSeverity[level]; !ok {
+		level = INFO
+	}
+	if format == "" {
+		format = LogFormatText
+	}
+	return &Logger{logSink: &logSink{out: out, level: level, format: format}}
+}
+
+// OpenLogger creates a logger appending to the file at path, rotated at DefaultLogMaxSize
+func OpenLogger(path string, level LogType, format string) (*Logger, error) {
+	if !ValidLogFormat(format) {
+		return nil, fmt.Errorf("--log-format has to be 'text' or 'json'")
+	}
+	file, err := OpenRotatingFile(path, DefaultLogMaxSize, DefaultLogMaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the log file: %v", err)
+	}
+	return NewLogger(file, level, format), nil
+}
+
+// With returns a logger adding the key-value pairs to every entry
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := append(append([]interface{}{}, l.fields...), keyvals...)
+	return &Logger{logSink: l.logSink, fields: fields}
+}
+
+// Redact registers secrets, such as a password, that are masked wherever they appear
+func (l *Logger) Redact(secrets ...string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, secret := range secrets {
+		if secret != "" && indexOf(l.secrets, secret) < 0 {
+			l.secrets = append(l.secrets, secret)
+		}
+	}
+	// the longest first, so a secret containing another one is masked entirely
+	sort.Slice(l.secrets, func(i, j int) bool { return len(l.secrets[i]) > len(l.secrets[j]) })
+}
+
+// Enabled tells whether the entries of level are written
+func (l *Logger) Enabled(level LogType) bool {
+	return l != nil && logSeverity[level] >= logSeverity[l.level]
+}
+
+// Debug writes a DEBUG entry
+func (l *Logger) Debug(message string, keyvals ...interface{}) { l.Log(DEBUG, message, keyvals...) }
+
+// Info writes an INFO entry
+func (l *Logger) Info(message string, keyvals ...interface{}) { l.Log(INFO, message, keyvals...) }
+
+// Warn writes a WARNING entry
+func (l *Logger) Warn(message string, keyvals ...interface{}) { l.Log(WARNING, message, keyvals...) }
+
+// Error writes an ERROR entry
+func (l *Logger) Error(message string, keyvals ...interface{}) { l.Log(ERROR, message, keyvals...) }
+
+// Log writes an entry made of a message and key-value pairs, the keys being strings
+func (l *Logger) Log(level LogType, message string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	keyvals = append(append([]interface{}{}, l.fields...), keyvals...)
+	if len(keyvals)%2 == 1 {
+		keyvals = append(keyvals, nil)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().Format(time.RFC3339)
+	message = l.redact(strings.TrimSpace(message))
+	var entry []byte
+	if l.format == LogFormatJSON {
+		fields := map[string]interface{}{"time": now, "level": level, "msg": message}
+		for i := 0; i < len(keyvals); i += 2 {
+			key := fmt.Sprint(keyvals[i])
+			fields[key] = l.jsonValue(key, keyvals[i+1])
+		}
+		entry, _ = json.Marshal(fields)
+	} else {
+		line := fmt.Sprintf("time=%s level=%s msg=%s", now, level, quoteValue(message))
+		for i := 0; i < len(keyvals); i += 2 {
+			key := fmt.Sprint(keyvals[i])
+			line += " " + key + "=" + quoteValue(l.textValue(key, keyvals[i+1]))
+		}
+		entry = []byte(line)
+	}
+	l.out.Write(append(entry, '\n'))
+}
+
+// Close closes the output of the logger, if it can be
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	if closer, ok := l.out.(io.Closer); ok && l.out != os.Stdout && l.out != os.Stderr {
+		return closer.Close()
+	}
+	return nil
+}
+
+// redact masks the secrets of a text
+func (l *Logger) redact(text string) string {
+	for _, secret := range l.secrets {
+		text = strings.Replace(text, secret, redacted, -1)
+	}
+	return RedactURL(text)
+}
+
+// textValue returns the text of a field
+func (l *Logger) textValue(key string, value interface{}) string {
+	if isSecretKey(key) {
+		return redacted
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case error:
+		return l.redact(v.Error())
+	case fmt.Stringer:
+		return l.redact(v.String())
+	default:
+		return l.redact(fmt.Sprint(v))
+	}
+}
+
+// jsonValue keeps the numbers and booleans of a field as such, the rest as text
+func (l *Logger) jsonValue(key string, value interface{}) interface{} {
+	switch value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool:
+		if !isSecretKey(key) {
+			return value
+		}
+	case nil:
+		return nil
+	}
+	return l.textValue(key, value)
+}
+
+// isSecretKey tells whether a field is named like a password
+func isSecretKey(key string) bool {
+	key = strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteValue quotes a text value when it would be ambiguous unquoted
+func quoteValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// RotatingFile a log file renamed once it grows over MaxSize, the MaxBackups most recent
+// ones are kept as path.1 (the newest) to path.N
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending, rotating it at maxSize bytes
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, after rotating the file when p would make it grow over MaxSize
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups by one, the current file becoming path.1
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	if f.MaxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", f.Path, f.MaxBackups))
+		for i := f.MaxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.Path, i), fmt.Sprintf("%s.%d", f.Path, i+1))
+		}
+		if err := os.Rename(f.Path, f.Path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.Path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,63 @@
+package downloader
+
+// The rows of the pages and links APIs as Go values, see RowDecoder and Downloader.OnBatch.
+// Fields are matched to the columns by their `column` tag; the columns without a field,
+// such as those added to the API later on, are kept in Extra.
+
+// Page a row of the pages API requested without details
+type Page struct {
+	ID         uint64 `column:"id" json:"id"`
+	URL        string `column:"url" json:"url"`
+	StatusCode int    `column:"status_code" json:"status_code"`
+	// Extra the columns that have no field, by name
+	Extra map[string]string `column:"*" json:"extra,omitempty"`
+}
+
+// PageDetails a row of the pages API requested with details
+type PageDetails struct {
+	Page
+	Title        string  `column:"title" json:"title"`
+	ContentType  string  `column:"content_type" json:"content_type"`
+	Depth        int     `column:"depth" json:"depth"`
+	Indexable    bool    `column:"indexable" json:"indexable"`
+	Canonical    string  `column:"canonical" json:"canonical"`
+	ResponseTime float64 `column:"response_time" json:"response_time"`
+	Size         int64   `column:"size" json:"size"`
+	InLinks      int     `column:"inlinks" json:"inlinks"`
+	OutLinks     int     `column:"outlinks" json:"outlinks"`
+}
+
+// Link a row of the links API requested without details
+type Link struct {
+	SourceID  uint64 `column:"source_id" json:"source_id"`
+	SourceURL string `column:"source_url" json:"source_url"`
+	TargetID  uint64 `column:"target_id" json:"target_id"`
+	TargetURL string `column:"target_url" json:"target_url"`
+	// Type e.g. 301 for a redirect, see the filter type:30x
+	Type string `column:"type" json:"type"`
+	// Extra the columns that have no field, by name
+	Extra map[string]string `column:"*" json:"extra,omitempty"`
+}
+
+// LinkDetails a row of the links API requested with details
+type LinkDetails struct {
+	Link
+	AnchorText       string `column:"anchor_text" json:"anchor_text"`
+	Rel              string `column:"rel" json:"rel"`
+	SourceStatusCode int    `column:"source_status_code" json:"source_status_code"`
+	TargetStatusCode int    `column:"target_status_code" json:"target_status_code"`
+}
+
+// rowModel returns the value the rows of the given mode are decoded into
+func rowModel(mode string, deep bool) interface{} {
+	switch {
+	case mode == "links" && deep:
+		return LinkDetails{}
+	case mode == "links":
+		return Link{}
+	case deep:
+		return PageDetails{}
+	default:
+		return Page{}
+	}
+}
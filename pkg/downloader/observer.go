@@ -0,0 +1,172 @@
+package downloader
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Observer is notified of the events of a download, see Downloader.Subscribe. The
+// methods are called from the goroutine running the download and should return
+// quickly. Embed NopObserver to only implement some of them.
+type Observer interface {
+	// OnStart the download starts or is resumed
+	OnStart(event StartEvent)
+	// OnChunkFetched a chunk was requested, and read if it was received
+	OnChunkFetched(event ChunkEvent)
+	// OnRetry a failed request is about to be made again
+	OnRetry(event RetryEvent)
+	// OnThrottle the chunk size was lowered after repeated server timeouts
+	OnThrottle(chunkSize uint64)
+	// OnTargetStart and OnTargetDone surround the download of the links of every target page
+	OnTargetStart(event TargetEvent)
+	OnTargetDone(event TargetEvent)
+	// OnStageChange with --targets=self, the pages were downloaded and the links are next
+	OnStageChange(event StageEvent)
+	// OnLog an informative message or a warning
+	OnLog(level LogType, message string)
+	// OnComplete the download completed, with its final status
+	OnComplete(report StatusReport)
+	// OnError the download stopped on an error, it can be resumed
+	OnError(err error)
+}
+
+// StartEvent describes the download being started
+type StartEvent struct {
+	Crawl  uint64
+	Mode   string
+	Output string
+	// TotalElements the number of rows to download, DoneElements those already downloaded
+	// when resuming
+	TotalElements, DoneElements uint64
+	// Targets the number of target pages in targets mode
+	Targets int
+}
+
+// ChunkEvent describes a chunk request
+type ChunkEvent struct {
+	Chunk, ChunkSize uint64
+	StatusCode       int
+	// Latency from the request until the chunk was read
+	Latency time.Duration
+	// Bytes received, after decompression
+	Bytes int64
+	// Rows received, skipped rows excluded
+	Rows uint64
+	// Err if the chunk was cut off or failed validation
+	Err error
+}
+
+// RetryEvent describes a failed request about to be made again
+type RetryEvent struct {
+	Attempt int
+	Wait    time.Duration
+	Err     error
+}
+
+// TargetEvent describes the target page whose links are downloaded
+type TargetEvent struct {
+	PageID uint64
+	// Index of the target in the targets file, out of Total
+	Index, Total int
+	Elements     uint64
+}
+
+// StageEvent describes the switch from the pages to the links of a --targets=self download
+type StageEvent struct {
+	From, To string
+	// Output the file the links are written to
+	Output string
+}
+
+// NopObserver an Observer ignoring every event, to embed in partial observers
+type NopObserver struct{}
+
+// OnStart does nothing
+func (NopObserver) OnStart(StartEvent) {}
+
+// OnChunkFetched does nothing
+func (NopObserver) OnChunkFetched(ChunkEvent) {}
+
+// OnRetry does nothing
+func (NopObserver) OnRetry(RetryEvent) {}
+
+// OnThrottle does nothing
+func (NopObserver) OnThrottle(uint64) {}
+
+// OnTargetStart does nothing
+func (NopObserver) OnTargetStart(TargetEvent) {}
+
+// OnTargetDone does nothing
+func (NopObserver) OnTargetDone(TargetEvent) {}
+
+// OnStageChange does nothing
+func (NopObserver) OnStageChange(StageEvent) {}
+
+// OnLog does nothing
+func (NopObserver) OnLog(LogType, string) {}
+
+// OnComplete does nothing
+func (NopObserver) OnComplete(StatusReport) {}
+
+// OnError does nothing
+func (NopObserver) OnError(error) {}
+
+// Subscribe registers an observer of the download, before it is started
+func (d *Downloader) Subscribe(observer Observer) {
+	d.observers = append(d.observers, observer)
+}
+
+// notify calls event on every observer, the target workers notify the observers of
+// their parent
+func (d *Downloader) notify(event func(Observer)) {
+	if d.parent != nil {
+		d.parent.notify(event)
+		return
+	}
+	d.eventsMu.Lock()
+	defer d.eventsMu.Unlock()
+	for _, observer := range d.observers {
+		event(observer)
+	}
+}
+
+// chunkFetched tells the observers about the chunk just requested
+func (d *Downloader) chunkFetched(event ChunkEvent) {
+	event.Chunk, event.ChunkSize = d.client.ChunkNumber, d.client.ChunkSize
+	// the chunks of the target workers add up to the throughput of the download
+	root := d
+	if d.parent != nil {
+		root = d.parent
+	}
+	atomic.AddUint64(&root.receivedRows, event.Rows)
+	root.speed.observe(event.Rows, event.Bytes, event.Latency, time.Now())
+	if logger := d.logger(); logger.Enabled(DEBUG) {
+		fields := []interface{}{"chunk", event.Chunk, "chunk_size", event.ChunkSize, "status", event.StatusCode,
+			"latency", event.Latency, "bytes", event.Bytes, "rows", event.Rows}
+		if event.Err != nil {
+			fields = append(fields, "error", event.Err)
+		}
+		logger.Debug("chunk fetched", fields...)
+	}
+	d.notify(func(o Observer) { o.OnChunkFetched(event) })
+}
+
+// waitRetry tells the observers a failed request is made again after wait, then waits
+func (d *Downloader) waitRetry(attempt int, wait time.Duration, err error) {
+	d.logger().Warn("retrying", "attempt", attempt, "wait", wait, "error", err)
+	d.notify(func(o Observer) { o.OnRetry(RetryEvent{Attempt: attempt, Wait: wait, Err: err}) })
+	time.Sleep(wait)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
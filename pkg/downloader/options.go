@@ -0,0 +1,531 @@
+package downloader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Options everything a download is set up with, see Downloader.SetupOptions. The same
+// type backs the command line flags, the web form and the entries of a batch manifest,
+// so the settings are validated in one place. The zero value of a setting means its default.
+type Options struct {
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	Crawl    uint64 `json:"crawl" yaml:"crawl"`
+	// Mode "pages" (default) or "links"
+	Mode      string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	NoDetails bool   `json:"noDetails,omitempty" yaml:"noDetails,omitempty"`
+	Filter    string `json:"filter,omitempty" yaml:"filter,omitempty"`
+	Order     string `json:"order,omitempty" yaml:"order,omitempty"`
+	// Format the chunks are requested in, FormatTSV (default) or FormatJSON
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+	// Targets "self", the path of a file listing the target page IDs or URLs, or
+	// StdinTargets to read them from stdin
+	Targets string `json:"targets,omitempty" yaml:"targets,omitempty"`
+	// TargetsColumn the column of the targets file holding the targets, see Downloader.TargetsColumn
+	TargetsColumn string `json:"targetsColumn,omitempty" yaml:"targetsColumn,omitempty"`
+	// Outgoing downloads the links found on the targets instead of the links to them
+	Outgoing bool `json:"outgoing,omitempty" yaml:"outgoing,omitempty"`
+	// Prescan asks the total elements of all the targets first, see Downloader.Prescan
+	Prescan bool `json:"prescan,omitempty" yaml:"prescan,omitempty"`
+	// TargetWorkers the number of targets downloaded at once, DefaultTargetWorkers if not set
+	TargetWorkers int `json:"targetWorkers,omitempty" yaml:"targetWorkers,omitempty"`
+	// TargetColumn prepends the page ID of the target to every row, see Downloader.TargetColumn
+	TargetColumn bool `json:"targetColumn,omitempty" yaml:"targetColumn,omitempty"`
+	// OutputDir writes every target to its own file named after OutputTemplate,
+	// DefaultOutputTemplate if not set, see Downloader.OutputDir
+	OutputDir      string `json:"outputDir,omitempty" yaml:"outputDir,omitempty"`
+	OutputTemplate string `json:"outputTemplate,omitempty" yaml:"outputTemplate,omitempty"`
+
+	// Output the path of the output file, StdoutFilename to write to stdout
+	Output   string `json:"output,omitempty" yaml:"output,omitempty"`
+	NoResume bool   `json:"noResume,omitempty" yaml:"noResume,omitempty"`
+	// Incremental only appends the rows added since the previous download, see Downloader.Incremental
+	Incremental bool `json:"incremental,omitempty" yaml:"incremental,omitempty"`
+	// StateFile an explicit path for the resume file
+	StateFile string `json:"stateFile,omitempty" yaml:"stateFile,omitempty"`
+	// OutputType OutputTSV or OutputSQLite, guessed from the output extension if not set
+	OutputType string `json:"outputType,omitempty" yaml:"outputType,omitempty"`
+	// SplitRows and SplitSize (in bytes) rotate the output into part files
+	SplitRows uint64 `json:"splitRows,omitempty" yaml:"splitRows,omitempty"`
+	SplitSize int64  `json:"splitSize,omitempty" yaml:"splitSize,omitempty"`
+	// S3 if set, the output is uploaded to S3-compatible object storage
+	S3 *S3Config `json:"s3,omitempty" yaml:"s3,omitempty"`
+
+	ChunkNumber uint64 `json:"chunkNumber,omitempty" yaml:"chunkNumber,omitempty"`
+	// ChunkSize DefaultChunkSize if not set
+	ChunkSize uint64 `json:"chunkSize,omitempty" yaml:"chunkSize,omitempty"`
+	// MaxRate the bytes read per second and MaxRequestsPerMinute the requests made to
+	// Audisto API per minute, 0 means no limit
+	MaxRate              int64 `json:"maxRate,omitempty" yaml:"maxRate,omitempty"`
+	MaxRequestsPerMinute int   `json:"maxRequestsPerMinute,omitempty" yaml:"maxRequestsPerMinute,omitempty"`
+	// MaxLineLength DefaultMaxLineLength if not set
+	MaxLineLength int  `json:"maxLineLength,omitempty" yaml:"maxLineLength,omitempty"`
+	Strict        bool `json:"strict,omitempty" yaml:"strict,omitempty"`
+	// DriftCheck DriftWarn (default), DriftRedownload, DriftFail or DriftOff
+	DriftCheck string `json:"onDrift,omitempty" yaml:"onDrift,omitempty"`
+	// DriftInterval DefaultDriftInterval if not set, see Downloader.DriftInterval
+	DriftInterval int `json:"driftInterval,omitempty" yaml:"driftInterval,omitempty"`
+
+	Columns      []string `json:"columns,omitempty" yaml:"columns,omitempty"`
+	Where        string   `json:"where,omitempty" yaml:"where,omitempty"`
+	Offset       uint64   `json:"offset,omitempty" yaml:"offset,omitempty"`
+	Limit        uint64   `json:"limit,omitempty" yaml:"limit,omitempty"`
+	Sample       float64  `json:"sample,omitempty" yaml:"sample,omitempty"`
+	SampleSeed   int64    `json:"sampleSeed,omitempty" yaml:"sampleSeed,omitempty"`
+	SampleChunks bool     `json:"sampleChunks,omitempty" yaml:"sampleChunks,omitempty"`
+
+	// Hooks if set, are notified once the download completed or failed
+	Hooks *Hooks `json:"hooks,omitempty" yaml:"hooks,omitempty"`
+}
+
+// Option sets a field of Options, see NewOptions
+type Option func(*Options)
+
+// NewOptions builds Options out of functional options, e.g.
+//
+//	options := downloader.NewOptions(
+//		downloader.WithCredentials(username, password),
+//		downloader.WithCrawl(12345),
+//		downloader.WithOutput("myCrawl.tsv"),
+//	)
+func NewOptions(opts ...Option) Options {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithCredentials sets the Audisto API username and password
+func WithCredentials(username, password string) Option {
+	return func(o *Options) { o.Username, o.Password = username, password }
+}
+
+// WithCrawl sets the ID of the crawl to download
+func WithCrawl(crawl uint64) Option {
+	return func(o *Options) { o.Crawl = crawl }
+}
+
+// WithMode sets the download mode, "pages" or "links"
+func WithMode(mode string) Option {
+	return func(o *Options) { o.Mode = mode }
+}
+
+// WithoutDetails requests the rows without their details
+func WithoutDetails() Option {
+	return func(o *Options) { o.NoDetails = true }
+}
+
+// WithFilter sets the filter of the requested rows
+func WithFilter(filter string) Option {
+	return func(o *Options) { o.Filter = filter }
+}
+
+// WithOrder sets the order of the requested rows
+func WithOrder(order string) Option {
+	return func(o *Options) { o.Order = order }
+}
+
+// WithFormat sets the format the chunks are requested in, FormatTSV or FormatJSON
+func WithFormat(format string) Option {
+	return func(o *Options) { o.Format = format }
+}
+
+// WithTargets sets the link targets, "self" or the path of a file listing page IDs
+func WithTargets(targets string) Option {
+	return func(o *Options) { o.Targets = targets }
+}
+
+// WithTargetsColumn reads the targets from a column of the targets file, by name or number
+func WithTargetsColumn(column string) Option {
+	return func(o *Options) { o.TargetsColumn = column }
+}
+
+// WithOutgoingLinks downloads the links found on the targets instead of the links to them
+func WithOutgoingLinks() Option {
+	return func(o *Options) { o.Outgoing = true }
+}
+
+// WithPrescan asks the total elements of all the targets before downloading them
+func WithPrescan() Option {
+	return func(o *Options) { o.Prescan = true }
+}
+
+// WithTargetWorkers sets the number of targets downloaded at once
+func WithTargetWorkers(workers int) Option {
+	return func(o *Options) { o.TargetWorkers = workers }
+}
+
+// WithTargetColumn prepends the page ID of the target to every row
+func WithTargetColumn() Option {
+	return func(o *Options) { o.TargetColumn = true }
+}
+
+// WithOutputDir writes every target to its own file in dir, named after template
+// (DefaultOutputTemplate if empty)
+func WithOutputDir(dir, template string) Option {
+	return func(o *Options) { o.OutputDir, o.OutputTemplate = dir, template }
+}
+
+// WithOutput sets the path of the output file
+func WithOutput(output string) Option {
+	return func(o *Options) { o.Output = output }
+}
+
+// WithoutResume starts the download again instead of resuming it
+func WithoutResume() Option {
+	return func(o *Options) { o.NoResume = true }
+}
+
+// WithIncremental only appends the rows added since the previous download to the output
+func WithIncremental() Option {
+	return func(o *Options) { o.Incremental = true }
+}
+
+// WithStateFile sets an explicit path for the resume file
+func WithStateFile(path string) Option {
+	return func(o *Options) { o.StateFile = path }
+}
+
+// WithOutputType sets the output type, OutputTSV or OutputSQLite
+func WithOutputType(outputType string) Option {
+	return func(o *Options) { o.OutputType = outputType }
+}
+
+// WithSplit rotates the output into part files of at most rows rows or size bytes, 0 means no limit
+func WithSplit(rows uint64, size int64) Option {
+	return func(o *Options) { o.SplitRows, o.SplitSize = rows, size }
+}
+
+// WithS3 uploads the output to S3-compatible object storage
+func WithS3(config S3Config) Option {
+	return func(o *Options) { o.S3 = &config }
+}
+
+// WithChunks sets the first chunk number and the number of rows requested at once
+func WithChunks(number, size uint64) Option {
+	return func(o *Options) { o.ChunkNumber, o.ChunkSize = number, size }
+}
+
+// WithRateLimit limits the bytes read per second and the requests made per minute,
+// 0 means no limit
+func WithRateLimit(bytesPerSecond int64, requestsPerMinute int) Option {
+	return func(o *Options) { o.MaxRate, o.MaxRequestsPerMinute = bytesPerSecond, requestsPerMinute }
+}
+
+// WithMaxLineLength sets the maximum length in bytes of a single row
+func WithMaxLineLength(length int) Option {
+	return func(o *Options) { o.MaxLineLength = length }
+}
+
+// WithStrict makes the download fail on the first integrity anomaly
+func WithStrict() Option {
+	return func(o *Options) { o.Strict = true }
+}
+
+// WithDriftCheck sets what to do when the data shifts between chunks
+func WithDriftCheck(mode string) Option {
+	return func(o *Options) { o.DriftCheck = mode }
+}
+
+// WithDriftInterval checks the boundary of every nth chunk, 1 for every chunk
+func WithDriftInterval(n int) Option {
+	return func(o *Options) { o.DriftInterval = n }
+}
+
+// WithColumns only writes these columns, by header name
+func WithColumns(columns ...string) Option {
+	return func(o *Options) { o.Columns = columns }
+}
+
+// WithWhere only writes the rows matching the expression, see ParseExpression
+func WithWhere(where string) Option {
+	return func(o *Options) { o.Where = where }
+}
+
+// WithRange skips the first offset rows and downloads at most limit rows, 0 meaning all of them
+func WithRange(offset, limit uint64) Option {
+	return func(o *Options) { o.Offset, o.Limit = offset, limit }
+}
+
+// WithSample only writes a share of the rows picked with the seed, by blocks of
+// SampleBlockRows rows when chunks is set
+func WithSample(rate float64, seed int64, chunks bool) Option {
+	return func(o *Options) { o.Sample, o.SampleSeed, o.SampleChunks = rate, seed, chunks }
+}
+
+// WithHooks notifies webhooks and runs commands once the download completed or failed
+func WithHooks(hooks Hooks) Option {
+	return func(o *Options) { o.Hooks = &hooks }
+}
+
+// normalize trims the string settings and lowercases the keywords
+func (o *Options) normalize() {
+	o.Username = strings.TrimSpace(o.Username)
+	o.Password = strings.TrimSpace(o.Password)
+	o.Mode = strings.ToLower(strings.TrimSpace(o.Mode))
+	if o.Mode == "" {
+		o.Mode = "pages"
+	}
+	o.Filter = strings.TrimSpace(o.Filter)
+	o.Order = strings.TrimSpace(o.Order)
+	o.Format = strings.ToLower(strings.TrimSpace(o.Format))
+	o.Targets = strings.TrimSpace(o.Targets)
+	if strings.EqualFold(o.Targets, "self") {
+		o.Targets = "self"
+	}
+	o.TargetsColumn = strings.TrimSpace(o.TargetsColumn)
+	o.Output = strings.TrimSpace(o.Output)
+	o.OutputDir = strings.TrimSpace(o.OutputDir)
+	o.OutputTemplate = strings.TrimSpace(o.OutputTemplate)
+	if o.OutputDir != "" {
+		if o.OutputTemplate == "" {
+			o.OutputTemplate = DefaultOutputTemplate
+		}
+		if o.Output == "" {
+			// the output lists the files of the targets
+			o.Output = filepath.Join(o.OutputDir, TargetsIndexFilename)
+		}
+	}
+	o.StateFile = strings.TrimSpace(o.StateFile)
+	o.OutputType = strings.ToLower(strings.TrimSpace(o.OutputType))
+	o.DriftCheck = strings.ToLower(strings.TrimSpace(o.DriftCheck))
+	o.Where = strings.TrimSpace(o.Where)
+	if o.MaxLineLength == 0 {
+		o.MaxLineLength = DefaultMaxLineLength
+	}
+
+	var columns []string
+	for _, column := range o.Columns {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	o.Columns = columns
+
+	if o.S3 != nil {
+		o.S3.Endpoint = strings.TrimSpace(o.S3.Endpoint)
+		o.S3.Bucket = strings.TrimSpace(o.S3.Bucket)
+		o.S3.Prefix = strings.TrimSpace(o.S3.Prefix)
+	}
+}
+
+// Validate normalizes the options and checks they make a valid download
+func (o *Options) Validate() error {
+	return o.validate(true)
+}
+
+// validate checks the options, and that the targets file exists when checkFiles is set.
+// The targets of a pipeline stage are only written by the stages before it.
+func (o *Options) validate(checkFiles bool) error {
+	o.normalize()
+
+	if o.Username == "" || o.Password == "" || o.Crawl == 0 {
+		return fmt.Errorf("--username, --password and --crawl are required")
+	}
+
+	if o.Mode != "pages" && o.Mode != "links" {
+		return fmt.Errorf("mode has to be 'links' or 'pages', if this flag is dropped, it will default to 'pages'")
+	}
+
+	if !ValidFormat(o.Format) {
+		return fmt.Errorf("--format has to be 'tsv' or 'json'")
+	}
+
+	if !ValidDriftCheck(o.DriftCheck) {
+		return fmt.Errorf("--on-drift has to be 'warn', 'redownload', 'fail' or 'off'")
+	}
+	if o.DriftInterval < 0 {
+		return fmt.Errorf("--drift-interval can't be negative")
+	}
+
+	if o.Where != "" {
+		if _, err := ParseExpression(o.Where); err != nil {
+			return fmt.Errorf("--where: %v", err)
+		}
+	}
+
+	if o.Sample < 0 || o.Sample > 1 {
+		return fmt.Errorf("--sample has to be a rate between 0 and 1, e.g. 0.01 for 1%%")
+	}
+
+	if (o.Offset > 0 || o.Limit > 0 || o.Sample > 0) && o.Targets != "" {
+		return fmt.Errorf("--offset, --limit and --sample can't be used with --targets")
+	}
+
+	if o.Prescan && o.Targets == "" {
+		return fmt.Errorf("--prescan asks the total elements of the targets, set --targets as well")
+	}
+
+	if o.TargetWorkers < 0 {
+		return fmt.Errorf("--target-workers has to be positive")
+	}
+
+	if o.TargetsColumn != "" && (o.Targets == "" || o.Targets == "self") {
+		return fmt.Errorf("--targets-column reads the targets from a column of the targets file, set --targets=FILE as well")
+	}
+
+	if o.Outgoing && (o.Targets == "" || o.Targets == "self") {
+		return fmt.Errorf("--outgoing downloads the links found on the targets, set --targets=FILE as well")
+	}
+
+	if o.TargetColumn && o.Targets == "" {
+		return fmt.Errorf("--target-column adds the page ID of the target to the rows, set --targets as well")
+	}
+
+	if o.OutputDir != "" {
+		if o.Targets == "" || o.Targets == "self" {
+			return fmt.Errorf("--output-dir writes a file per target of a targets file, set --targets=FILE as well")
+		}
+		if !strings.Contains(o.OutputTemplate, "{target}") && !strings.Contains(o.OutputTemplate, "{index}") {
+			return fmt.Errorf("--output-template has to contain {target} or {index}, so every target gets its own file")
+		}
+		if o.S3 != nil {
+			return fmt.Errorf("--output-dir writes local files, it can't be used with --s3-bucket")
+		}
+	}
+
+	if (len(o.Columns) > 0 || o.Where != "") && o.Targets == "self" {
+		return fmt.Errorf("--targets=self reads the page IDs back from the output file, it can't be used with --columns or --where")
+	}
+
+	if o.Incremental {
+		if o.Output == "" || o.Output == StdoutFilename || o.S3 != nil {
+			return fmt.Errorf("--incremental appends the new rows to the output file, set --output to a local file")
+		}
+		if o.SplitRows > 0 || o.SplitSize > 0 {
+			return fmt.Errorf("--incremental appends the new rows to a single TSV file, it can't be used with split outputs")
+		}
+		if o.Targets != "" || o.Offset > 0 || o.Limit > 0 {
+			return fmt.Errorf("--incremental downloads the rows added at the end, it can't be used with --targets, --offset or --limit")
+		}
+	}
+
+	if !ValidOutputType(o.OutputType) {
+		return fmt.Errorf("--output-type has to be 'tsv' or 'sqlite'")
+	}
+
+	if o.SplitSize < 0 {
+		return fmt.Errorf("--split-size has to be a positive size")
+	}
+
+	if o.S3 != nil {
+		if err := o.S3.validate(); err != nil {
+			return err
+		}
+		if o.S3.AccessKey == "" || o.S3.SecretKey == "" {
+			return fmt.Errorf("Set --s3-access-key and --s3-secret-key, or $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+		}
+		if o.Output == "" || o.Output == StdoutFilename {
+			return fmt.Errorf("Set --output to name the object uploaded to S3")
+		}
+	}
+
+	if o.Hooks != nil {
+		if err := o.Hooks.validate(); err != nil {
+			return err
+		}
+	}
+
+	if o.MaxRate < 0 {
+		return fmt.Errorf("--max-rate has to be a positive size per second")
+	}
+
+	if o.MaxRequestsPerMinute < 0 {
+		return fmt.Errorf("--max-requests-per-minute has to be a positive number")
+	}
+
+	if o.MaxLineLength < 1 {
+		return fmt.Errorf("--max-line-length has to be a positive number of bytes")
+	}
+
+	// validate targets / mode / filter combinations
+	if o.Targets != "" {
+
+		// do not allow --filter when --targets is being used with a FILEPATH
+		if o.Filter != "" && o.Targets != "self" {
+			return fmt.Errorf("Set either --filter or --targets, but not both. Except when --targets=self")
+		}
+
+		// --mode=pages is only allowed when targets=self
+		if o.Targets == "self" && o.Mode != "pages" {
+			return fmt.Errorf("Set --mode=pages to use --targets=self")
+		}
+
+		// --targets=FILEPATH is only allowed when mode is set to links
+		// we'd also make sure the file exists.
+		if o.Targets != "self" {
+
+			if o.Mode != "links" {
+				return fmt.Errorf("Set --mode=links to use --targets=FILEPATH")
+			}
+
+			if _, err := os.Stat(o.Targets); checkFiles && o.Targets != StdinTargets && os.IsNotExist(err) {
+				return fmt.Errorf("%s file does not exist", o.Targets)
+			}
+		}
+	}
+	return nil
+}
+
+// NewClientOptions creates an AudistoAPIClient for the crawl, mode, rows and rate limits
+// of the options
+func NewClientOptions(o Options) (*AudistoAPIClient, error) {
+	client, err := NewClient(o.Username, o.Password, o.Crawl, o.Mode, o.NoDetails, o.ChunkNumber,
+		o.ChunkSize, o.Filter, o.Order)
+	if err != nil {
+		return client, err
+	}
+	client.Outgoing = o.Outgoing
+	client.SetMaxRate(o.MaxRate)
+	client.SetMaxRequestsPerMinute(o.MaxRequestsPerMinute)
+	return client, nil
+}
+
+// Manifest a batch of downloads, run one after the other. The credentials at the top
+// apply to the downloads that don't set their own.
+//
+//	username: USERNAME
+//	password: PASSWORD
+//	downloads:
+//	  - crawl: 12345
+//	    output: pages.tsv
+//	  - crawl: 12345
+//	    mode: links
+//	    output: links.tsv
+type Manifest struct {
+	Username  string    `json:"username,omitempty" yaml:"username,omitempty"`
+	Password  string    `json:"password,omitempty" yaml:"password,omitempty"`
+	Downloads []Options `json:"downloads" yaml:"downloads"`
+}
+
+// LoadManifest reads a YAML or JSON manifest, the downloads are not validated yet
+func LoadManifest(path string) (*Manifest, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON being a subset of YAML, the YAML parser reads both
+	var manifest Manifest
+	if err = yaml.UnmarshalStrict(content, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+	}
+	if len(manifest.Downloads) == 0 {
+		return nil, fmt.Errorf("%s lists no downloads", filepath.Base(path))
+	}
+
+	for i := range manifest.Downloads {
+		download := &manifest.Downloads[i]
+		if download.Username == "" && download.Password == "" {
+			download.Username, download.Password = manifest.Username, manifest.Password
+		}
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,497 @@
+package downloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// rowWriter is where the downloaded rows end up
+type rowWriter interface {
+	// writeHeader is called once, before the first row of a new output
+	writeHeader(header []byte) error
+	writeRow(row []byte) error
+	// flush is called after every chunk, before the progress is persisted
+	flush() error
+	close() error
+}
+
+// rewinder is implemented by outputs able to drop everything written after a given
+// offset, which is needed to download a target again.
+type rewinder interface {
+	offset() int64
+	rewind(offset int64) error
+}
+
+// progressKeeper is implemented by outputs committing the download progress along with
+// the rows, which is then more reliable than the resume file.
+type progressKeeper interface {
+	// committedElements returns the number of downloaded elements the output holds,
+	// and false if it doesn't know yet
+	committedElements() (uint64, bool, error)
+}
+
+// Output types
+const (
+	// OutputTSV tab separated values, as served by the API (default)
+	OutputTSV = "tsv"
+	// OutputSQLite a table of a SQLite database
+	OutputSQLite = "sqlite"
+)
+
+// ValidOutputType checks the value of an output type
+func ValidOutputType(outputType string) bool {
+	switch outputType {
+	case "", OutputTSV, OutputSQLite:
+		return true
+	}
+	return false
+}
+
+// writeError an error writing to the output, which unlike network errors can't be retried
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string {
+	return fmt.Sprintf("Error while writing the output: %v", e.err)
+}
+
+// openOutput opens the output matching the download settings, appending to it when resuming
+func (d *Downloader) openOutput(resume bool) (rowWriter, error) {
+	switch d.outputType() {
+	case OutputSQLite:
+		return newSQLiteOutput(d, resume)
+	case OutputS3:
+		return newS3Output(d, resume)
+	}
+	if d.isSplit() {
+		if !resume || d.Split == nil {
+			d.Split = &SplitState{}
+		}
+		return newPartsOutput(d.OutputFilename, d.SplitRows, d.SplitSize, d.Split, []byte(d.outputHeader()), resume)
+	}
+	return newFileOutput(d.OutputFilename, resume)
+}
+
+// outputType returns the type of the output, guessed from the file extension unless set
+func (d *Downloader) outputType() string {
+	if d.S3 != nil {
+		return OutputS3
+	}
+	if d.OutputType != "" {
+		return d.OutputType
+	}
+	switch strings.ToLower(path.Ext(d.OutputFilename)) {
+	case ".sqlite", ".sqlite3", ".db":
+		return OutputSQLite
+	}
+	return OutputTSV
+}
+
+// validateOutput checks the output settings go together
+func (d *Downloader) validateOutput() error {
+	if d.S3 != nil {
+		if err := d.S3.validate(); err != nil {
+			return err
+		}
+		if d.OutputType != "" && d.OutputType != OutputTSV {
+			return fmt.Errorf("only TSV outputs can be uploaded to S3")
+		}
+		if d.isStdout() {
+			return fmt.Errorf("set --output to name the object uploaded to S3")
+		}
+		if d.isSplit() {
+			return fmt.Errorf("an output uploaded to S3 can't be split into part files")
+		}
+		if d.isInTargetsMode() {
+			// the resume file doesn't tell which target the uploaded parts end with
+			return fmt.Errorf("downloads using --targets can't be uploaded to S3")
+		}
+		if d.DriftCheck == DriftRedownload {
+			return fmt.Errorf("uploaded parts can't be downloaded again, use another drift check mode")
+		}
+		return nil
+	}
+
+	if d.outputType() == OutputSQLite {
+		if !sqliteSupported {
+			return fmt.Errorf("this build of data-downloader can't write SQLite databases, it was built without cgo")
+		}
+		if d.isStdout() {
+			return fmt.Errorf("a SQLite database can't be written to stdout")
+		}
+		if d.isSplit() {
+			return fmt.Errorf("a SQLite database can't be split into part files")
+		}
+		if d.currentTargetsFilename == "self" {
+			return fmt.Errorf("--targets=self reads the pages it downloads back from a TSV output, it can't be used with SQLite")
+		}
+		if d.Incremental {
+			return fmt.Errorf("--incremental appends the new rows to a single TSV file, it can't be used with SQLite")
+		}
+	}
+
+	if d.isSplit() {
+		if d.isStdout() {
+			return fmt.Errorf("the output can only be split into part files, not stdout")
+		}
+		if d.currentTargetsFilename == "self" {
+			return fmt.Errorf("--targets=self reads the pages it downloads back from the output file, it can't be split")
+		}
+		if d.DriftCheck == DriftRedownload {
+			return fmt.Errorf("part files can't be downloaded again, use another drift check mode")
+		}
+	}
+
+	if d.isStdout() {
+		if d.currentTargetsFilename == "self" {
+			return fmt.Errorf("--targets=self reads the pages it downloads back from the output file, it can't be used with stdout")
+		}
+		if d.DriftCheck == DriftRedownload {
+			return fmt.Errorf("rows written to stdout can't be downloaded again, use another drift check mode")
+		}
+	}
+	return nil
+}
+
+// resumeFromOutput takes the progress committed along with the rows over the one of the
+// resume file, which may lag behind if the download was interrupted in between.
+func (d *Downloader) resumeFromOutput() error {
+	output, ok := d.out.(progressKeeper)
+	if !ok || d.isInTargetsMode() {
+		return nil
+	}
+	done, known, err := output.committedElements()
+	if err != nil || !known || done == d.DoneElements {
+		return err
+	}
+
+	d.appendLog(INFO, fmt.Sprintf("Resuming from the %d elements committed to the output", done))
+	d.DoneElements = done
+	d.CurrentTarget.DoneElements = d.RowOffset + done
+	if done == 0 {
+		// nothing made it to the output, not even the header
+		d.Header = ""
+		d.headerColumns = 0
+	}
+	// the last row may not be the one the resume file knows of
+	d.CurrentTarget.LastRow = ""
+	return nil
+}
+
+// outputExists check if the output of a previous download exists
+func (d *Downloader) outputExists() bool {
+	if d.S3 != nil {
+		// the upload is only known by the resume file
+		return fExists(d.getResumeFilename()) == nil
+	}
+	if d.isSplit() {
+		return fExists(partFilename(d.OutputFilename, 1)) == nil
+	}
+	return fExists(d.OutputFilename) == nil
+}
+
+// fileOutput writes rows to a single file, or to stdout
+type fileOutput struct {
+	file   *os.File
+	writer *bufio.Writer
+	// size of the output, including what is still buffered
+	size int64
+}
+
+// newFileOutput creates the output file, or opens it for appending when resuming
+func newFileOutput(filename string, resume bool) (*fileOutput, error) {
+	if filename == "" || filename == StdoutFilename {
+		return &fileOutput{file: os.Stdout, writer: bufio.NewWriter(os.Stdout)}, nil
+	}
+
+	var file *os.File
+	var err error
+	if resume {
+		file, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0777)
+	} else {
+		file, err = os.Create(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileOutput{file: file, writer: bufio.NewWriter(file), size: info.Size()}, nil
+}
+
+func (o *fileOutput) writeHeader(header []byte) error {
+	return o.writeRow(header)
+}
+
+// writeRow writes a row followed by a line break
+func (o *fileOutput) writeRow(row []byte) error {
+	if _, err := o.writer.Write(row); err != nil {
+		return err
+	}
+	if err := o.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+	o.size += int64(len(row)) + 1
+	return nil
+}
+
+func (o *fileOutput) flush() error {
+	return o.writer.Flush()
+}
+
+func (o *fileOutput) close() error {
+	if err := o.flush(); err != nil {
+		return err
+	}
+	if o.file == os.Stdout {
+		return nil
+	}
+	return o.file.Close()
+}
+
+func (o *fileOutput) offset() int64 {
+	return o.size
+}
+
+// rewind drops everything written after the given offset
+func (o *fileOutput) rewind(offset int64) error {
+	if o.file == os.Stdout {
+		return fmt.Errorf("rows written to stdout can't be taken back")
+	}
+	if err := o.flush(); err != nil {
+		return err
+	}
+	if err := o.file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := o.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	o.size = offset
+	return nil
+}
+
+// SplitState keeps track of the part files of a split output, persisted in the resume file
+type SplitState struct {
+	// Part the number of the part currently written, starting with 1
+	Part int `json:"part"`
+	// Offset the size of the current part when the progress was last persisted
+	Offset int64      `json:"offset"`
+	Parts  []PartInfo `json:"parts"`
+}
+
+// PartInfo describes a part file of a split output, as listed in the manifest
+type PartInfo struct {
+	Filename string `json:"filename"`
+	// FirstRow and LastRow the range of data rows (excluding headers) of the whole
+	// output this part holds, starting with 1
+	FirstRow uint64 `json:"firstRow"`
+	LastRow  uint64 `json:"lastRow"`
+	Rows     uint64 `json:"rows"`
+	Size     int64  `json:"size"`
+	MD5      string `json:"md5,omitempty"`
+}
+
+// partFilename returns the name of the n-th part of an output, e.g. output_part0001.tsv
+func partFilename(output string, n int) string {
+	ext := path.Ext(output)
+	return fmt.Sprintf("%s_part%04d%s", output[0:len(output)-len(ext)], n, ext)
+}
+
+// ManifestFilename returns the name of the manifest listing the parts of a split output
+func ManifestFilename(output string) string {
+	ext := path.Ext(output)
+	return output[0:len(output)-len(ext)] + "_manifest.json"
+}
+
+// partsOutput writes rows to part files rotated after a number of rows and/or a size,
+// each part starting with the header.
+type partsOutput struct {
+	filename string
+	maxRows  uint64
+	maxSize  int64
+	header   []byte
+	state    *SplitState
+	current  *fileOutput
+}
+
+func newPartsOutput(filename string, maxRows uint64, maxSize int64, state *SplitState,
+	header []byte, resume bool) (*partsOutput, error) {
+
+	o := &partsOutput{
+		filename: filename,
+		maxRows:  maxRows,
+		maxSize:  maxSize,
+		state:    state,
+	}
+	if len(header) > 0 {
+		o.header = append([]byte(nil), header...)
+	}
+
+	if !resume || state.Part == 0 {
+		return o, o.openPart(1)
+	}
+
+	// drop whatever was written to the current part after the progress was last persisted
+	part := partFilename(filename, state.Part)
+	if err := os.Truncate(part, state.Offset); err != nil {
+		return nil, err
+	}
+	current, err := newFileOutput(part, true)
+	if err != nil {
+		return nil, err
+	}
+	o.current = current
+	return o, nil
+}
+
+func (o *partsOutput) part() *PartInfo {
+	return &o.state.Parts[len(o.state.Parts)-1]
+}
+
+// openPart creates the n-th part file, writing the header to it if we already have one
+func (o *partsOutput) openPart(n int) error {
+	filename := partFilename(o.filename, n)
+	current, err := newFileOutput(filename, false)
+	if err != nil {
+		return err
+	}
+	o.current = current
+
+	var firstRow uint64 = 1
+	if len(o.state.Parts) > 0 {
+		firstRow = o.part().LastRow + 1
+	}
+	o.state.Part = n
+	o.state.Parts = append(o.state.Parts, PartInfo{Filename: filename, FirstRow: firstRow, LastRow: firstRow - 1})
+
+	if o.header != nil {
+		return o.current.writeHeader(o.header)
+	}
+	return nil
+}
+
+// closePart closes the current part and records its checksum
+func (o *partsOutput) closePart() error {
+	if err := o.current.close(); err != nil {
+		return err
+	}
+	part := o.part()
+	part.Size = o.current.size
+	md5, err := getFileMD5Hash(part.Filename)
+	if err != nil {
+		return err
+	}
+	part.MD5 = md5
+	return nil
+}
+
+func (o *partsOutput) writeHeader(header []byte) error {
+	o.header = append([]byte(nil), header...)
+	return o.current.writeHeader(o.header)
+}
+
+func (o *partsOutput) writeRow(row []byte) error {
+	part := o.part()
+	full := o.maxRows > 0 && part.Rows >= o.maxRows
+	if o.maxSize > 0 && part.Rows > 0 && o.current.size+int64(len(row))+1 > o.maxSize {
+		full = true
+	}
+
+	if full {
+		if err := o.closePart(); err != nil {
+			return err
+		}
+		if err := o.openPart(o.state.Part + 1); err != nil {
+			return err
+		}
+		if err := o.writeManifest(); err != nil {
+			return err
+		}
+		part = o.part()
+	}
+
+	if err := o.current.writeRow(row); err != nil {
+		return err
+	}
+	part.Rows++
+	part.LastRow++
+	return nil
+}
+
+func (o *partsOutput) flush() error {
+	if err := o.current.flush(); err != nil {
+		return err
+	}
+	o.state.Offset = o.current.size
+	o.part().Size = o.current.size
+	return nil
+}
+
+func (o *partsOutput) close() error {
+	if err := o.closePart(); err != nil {
+		return err
+	}
+	o.state.Offset = o.current.size
+	return o.writeManifest()
+}
+
+// writeManifest lists the parts written so far, their row ranges and checksums
+func (o *partsOutput) writeManifest() error {
+	manifest := struct {
+		Output string     `json:"output"`
+		Rows   uint64     `json:"rows"`
+		Parts  []PartInfo `json:"parts"`
+	}{
+		Output: o.filename,
+		Rows:   o.part().LastRow,
+		Parts:  o.state.Parts,
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "	")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ManifestFilename(o.filename), content, 0644)
+}
+
+// ParseByteSize parses a human-readable size such as 512K, 100MB or 2G into bytes
+func ParseByteSize(original string) (int64, error) {
+	size := strings.ToUpper(strings.TrimSpace(original))
+	size = strings.TrimSuffix(strings.TrimSuffix(size, "B"), "I")
+
+	multiplier := int64(1)
+	if size != "" {
+		switch size[len(size)-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		case 'T':
+			multiplier = 1024 * 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			size = size[:len(size)-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(size), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", original)
+	}
+	return int64(value * float64(multiplier)), nil
+}
@@ -0,0 +1,360 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Pipeline downloads in stages, run one after the other, where a stage can be fed the
+// page IDs found by an earlier one: the links stages download the links of these pages,
+// the pages stages keep their rows only. The credentials and the crawl at the top apply
+// to the stages that don't set their own.
+//
+//	username: USERNAME
+//	password: PASSWORD
+//	crawl: 12345
+//	stages:
+//	  - name: broken
+//	    filter: http_status:404
+//	    output: broken.tsv
+//	  - name: links
+//	    from: broken
+//	    mode: links
+//	    output: links-to-broken.tsv
+//	  - name: sources
+//	    from: links
+//	    column: source_id
+//	    output: sources.tsv
+//
+// The progress of the whole pipeline is kept in a single state file, along with the
+// resume state of the stage being downloaded.
+type Pipeline struct {
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	Crawl    uint64 `json:"crawl,omitempty" yaml:"crawl,omitempty"`
+	// State the path of the state file, the definition file followed by ".audisto_" if not set
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+	// NoResume runs the pipeline again from its first stage
+	NoResume bool    `json:"noResume,omitempty" yaml:"noResume,omitempty"`
+	Stages   []Stage `json:"stages" yaml:"stages"`
+
+	// definition the MD5 of the definition file, to make sure it didn't change when resuming
+	definition string
+}
+
+// Stage a download of a pipeline, with the same settings as the downloads of a manifest
+type Stage struct {
+	Name string `json:"name" yaml:"name"`
+	// From the name of an earlier stage whose output holds the page IDs the stage is fed.
+	// A links stage downloads the links to these pages (or found on them, see
+	// Options.Outgoing), a pages stage only writes the rows of these pages. The pages
+	// API can't be asked for given pages, so a pages stage still downloads every page
+	// matching its filter.
+	From string `json:"from,omitempty" yaml:"from,omitempty"`
+	// Column the column of the output of From holding the page IDs, "id" by default for
+	// pages, e.g. "source_id" or "target_id" for links
+	Column string `json:"column,omitempty" yaml:"column,omitempty"`
+
+	Options `yaml:",inline"`
+}
+
+// PipelineState the progress of a pipeline, see Downloader.Pipeline
+type PipelineState struct {
+	// Definition the MD5 of the definition file
+	Definition string `json:"definition,omitempty"`
+	// Stage the index of the stage being downloaded, the ones before are completed
+	Stage int `json:"stage"`
+	// Outputs the MD5 of the outputs of the completed stages feeding later ones, by stage name
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+// StageRunner runs the download of a stage: it creates the Downloader, e.g. with a progress
+// channel and observers, sets it up with setup and starts it
+type StageRunner func(index int, stage *Stage, setup func(d *Downloader) error) error
+
+// LoadPipeline reads a YAML or JSON pipeline definition, the stages are not validated yet
+func LoadPipeline(path string) (*Pipeline, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON being a subset of YAML, the YAML parser reads both
+	var pipeline Pipeline
+	if err = yaml.UnmarshalStrict(content, &pipeline); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+	}
+	if pipeline.State == "" {
+		pipeline.State = path + resumerSuffix
+	}
+	if pipeline.definition, err = getFileMD5Hash(path); err != nil {
+		return nil, err
+	}
+	return &pipeline, nil
+}
+
+// Validate fills in the credentials and the crawl of the stages, feeds them the outputs
+// of the stages they are fed by and checks they make valid downloads
+func (p *Pipeline) Validate() error {
+	if len(p.Stages) == 0 {
+		return fmt.Errorf("the pipeline has no stages")
+	}
+	p.State = strings.TrimSpace(p.State)
+	if p.State == "" {
+		return fmt.Errorf("set the state file of the pipeline")
+	}
+
+	stages := make(map[string]*Stage)
+	outputs := map[string]string{p.State: "the state file"}
+	for i := range p.Stages {
+		stage := &p.Stages[i]
+		stage.Name = strings.TrimSpace(stage.Name)
+		stage.From = strings.TrimSpace(stage.From)
+		stage.Column = strings.TrimSpace(stage.Column)
+		if stage.Name == "" {
+			return fmt.Errorf("stage %d has no name", i+1)
+		}
+		if stages[stage.Name] != nil {
+			return fmt.Errorf("there are two stages named %q", stage.Name)
+		}
+		if stage.Username == "" && stage.Password == "" {
+			stage.Username, stage.Password = p.Username, p.Password
+		}
+		if stage.Crawl == 0 {
+			stage.Crawl = p.Crawl
+		}
+
+		if err := stage.validate(stages); err != nil {
+			return fmt.Errorf("stage %q: %v", stage.Name, err)
+		}
+		if other, ok := outputs[stage.Output]; ok && stage.Output != "" && stage.Output != StdoutFilename {
+			return fmt.Errorf("stage %q: %s is already written by %s", stage.Name, stage.Output, other)
+		}
+		outputs[stage.Output] = fmt.Sprintf("stage %q", stage.Name)
+		stages[stage.Name] = stage
+	}
+	return nil
+}
+
+// validate checks the settings of the stage, the stages before it being validated already
+func (s *Stage) validate(before map[string]*Stage) error {
+	if s.Targets != "" && s.From == "" {
+		return fmt.Errorf("set from instead of targets, the targets of a stage are found by an earlier stage")
+	}
+	if s.StateFile != "" {
+		return fmt.Errorf("the stages share the state file of the pipeline, set state at its top instead")
+	}
+	s.normalize()
+
+	if s.From == "" {
+		if s.Column != "" {
+			return fmt.Errorf("column reads the page IDs of an earlier stage, set from as well")
+		}
+		return s.Options.validate(true)
+	}
+
+	from, ok := before[s.From]
+	if !ok {
+		return fmt.Errorf("from has to name an earlier stage, there is no %q before", s.From)
+	}
+	if !from.writesFile() {
+		return fmt.Errorf("%q feeds a later stage, its output has to be a single local TSV file", s.From)
+	}
+	if s.Column == "" {
+		if from.Mode != "pages" {
+			return fmt.Errorf("set the column of the links of %q holding the page IDs, e.g. source_id or target_id", s.From)
+		}
+		s.Column = "id"
+	}
+	if len(from.Columns) > 0 && indexOf(from.Columns, s.Column) < 0 {
+		return fmt.Errorf("the output of %q has no %s column, add it to its columns", s.From, s.Column)
+	}
+
+	// the links stages read their targets from the output of the earlier stage, which
+	// is only written once the pipeline runs
+	if s.Mode == "links" {
+		s.Targets, s.TargetsColumn = from.Output, s.Column
+	}
+	return s.Options.validate(false)
+}
+
+// writesFile tells whether the output of the stage is a single local TSV file, which
+// later stages can read the page IDs from
+func (s *Stage) writesFile() bool {
+	d := Downloader{OutputFilename: s.Output, OutputType: s.OutputType, S3: s.S3}
+	return !d.isStdout() && d.outputType() == OutputTSV && s.OutputDir == "" &&
+		s.SplitRows == 0 && s.SplitSize == 0
+}
+
+// Run runs the stages one after the other with run, starting with the stage that was
+// interrupted. The pipeline has to be validated first.
+func (p *Pipeline) Run(run StageRunner) error {
+	state, resuming, err := p.loadState()
+	if err != nil {
+		return err
+	}
+
+	for i := state.Stage; i < len(p.Stages); i++ {
+		stage := &p.Stages[i]
+		state.Stage = i
+		options := stage.Options
+		options.StateFile = p.State
+		// only the stage found in the state file is resumed
+		options.NoResume = !resuming
+		resuming = false
+
+		pages, summary, err := p.stagePages(stage)
+		if err != nil {
+			return fmt.Errorf("stage %q: %v", stage.Name, err)
+		}
+		setup := func(d *Downloader) error {
+			d.Pipeline = state
+			d.pages = pages
+			if err := d.SetupOptions(options); err != nil {
+				return err
+			}
+			if summary != "" {
+				d.appendLog(WARNING, fmt.Sprintf("Keeping the rows of %d pages found by %q: %s\n", len(pages), stage.From, summary))
+			}
+			return nil
+		}
+		if err := run(i, stage, setup); err != nil {
+			return err
+		}
+
+		// the outputs feeding later stages must not change until these are completed
+		if p.feeds(stage.Name) {
+			md5, err := getFileMD5Hash(stage.Output)
+			if err != nil {
+				return err
+			}
+			state.Outputs[stage.Name] = md5
+		}
+		state.Stage = i + 1
+		if err := p.saveState(state); err != nil {
+			return err
+		}
+	}
+	return os.Remove(p.State)
+}
+
+// loadState reads the progress of the pipeline from its state file, resuming tells
+// whether the stage being downloaded can be resumed
+func (p *Pipeline) loadState() (state *PipelineState, resuming bool, err error) {
+	state = &PipelineState{Definition: p.definition, Outputs: make(map[string]string)}
+	if p.NoResume {
+		return state, false, nil
+	}
+	content, err := ioutil.ReadFile(p.State)
+	if os.IsNotExist(err) {
+		return state, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("pipeline state error: %v", err)
+	}
+
+	// the state file holds the resume state of the stage being downloaded, if it began
+	var saved struct {
+		Pipeline       *PipelineState `json:"pipeline"`
+		OutputFilename string         `json:"outputFilename"`
+	}
+	if err = json.Unmarshal(content, &saved); err != nil {
+		return nil, false, fmt.Errorf("pipeline state error: %v", err)
+	}
+	if saved.Pipeline == nil {
+		return nil, false, fmt.Errorf("%s is not the state of a pipeline", p.State)
+	}
+	if saved.Pipeline.Definition != p.definition {
+		return nil, false, fmt.Errorf("the pipeline definition changed since it was started; use --no-resume to run it again")
+	}
+	if saved.Pipeline.Stage > len(p.Stages) {
+		return nil, false, fmt.Errorf("resume meta info has been altered, abording an inconsistent resume")
+	}
+	for name, md5 := range saved.Pipeline.Outputs {
+		stage := p.stage(name)
+		if stage == nil {
+			return nil, false, fmt.Errorf("resume meta info has been altered, abording an inconsistent resume")
+		}
+		if current, err := getFileMD5Hash(stage.Output); err != nil || current != md5 {
+			return nil, false, fmt.Errorf("the output of stage %q changed since it was downloaded; use --no-resume to run the pipeline again", name)
+		}
+	}
+	if saved.Pipeline.Outputs == nil {
+		saved.Pipeline.Outputs = make(map[string]string)
+	}
+	return saved.Pipeline, saved.OutputFilename != "", nil
+}
+
+// saveState writes the progress of the pipeline between two stages
+func (p *Pipeline) saveState(state *PipelineState) error {
+	config, err := json.MarshalIndent(struct {
+		Pipeline *PipelineState `json:"pipeline"`
+	}{state}, "", "	")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.State, config, 0644)
+}
+
+// stagePages reads the page IDs the rows of a pages stage are restricted to, from the
+// output of the stage it is fed by, along with a summary of the lines ignored. The links
+// stages read them as their targets.
+func (p *Pipeline) stagePages(stage *Stage) (map[uint64]bool, string, error) {
+	if stage.From == "" || stage.Mode != "pages" {
+		return nil, "", nil
+	}
+	file, err := os.Open(p.stage(stage.From).Output)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	// an earlier stage without any row leaves no page to keep
+	pages := make(map[uint64]bool)
+	if info, err := file.Stat(); err != nil || info.Size() == 0 {
+		return pages, "", err
+	}
+	var summary targetsSummary
+	values, err := readTargetsColumn(file, stage.Column, &summary)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, value := range values {
+		id, err := strconv.ParseUint(value.value, 10, 64)
+		if err != nil {
+			summary.ignored = append(summary.ignored, value.line)
+			continue
+		}
+		pages[id] = true
+	}
+	sort.Ints(summary.ignored)
+	return pages, summary.String(), nil
+}
+
+// stage returns the stage with the given name, nil if there is none
+func (p *Pipeline) stage(name string) *Stage {
+	for i := range p.Stages {
+		if p.Stages[i].Name == name {
+			return &p.Stages[i]
+		}
+	}
+	return nil
+}
+
+// feeds tells whether a later stage is fed by the stage with the given name
+func (p *Pipeline) feeds(name string) bool {
+	for _, stage := range p.Stages {
+		if stage.From == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package downloader
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PrescanWorkers the number of targets asked for their total elements at once by the pre-scan
+const PrescanWorkers = 4
+
+// prescanTargets asks the total elements of the targets that are not known yet, a few at
+// once, so the whole download has a row count. The totals are kept in the resume file.
+func (d *Downloader) prescanTargets() error {
+	if d.TargetElements == nil {
+		d.TargetElements = make(map[uint64]uint64)
+	}
+
+	var pending []uint64
+	for _, id := range d.ids {
+		if _, ok := d.TargetElements[id]; !ok {
+			pending = append(pending, id)
+		}
+	}
+	if len(pending) > 0 {
+		d.appendLog(INFO, fmt.Sprintf("Pre-scanning the total elements of %d targets...", len(pending)))
+	}
+
+	ids := make(chan uint64)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < PrescanWorkers && i < len(pending); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// each worker filters on its own target, the rate limits are shared
+			client := d.client.clone()
+			for id := range ids {
+				client.SetTargetPageFilter(id)
+				total, err := client.GetTotalElements()
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("pre-scan of target %d: %v", id, err)
+				} else if err == nil {
+					d.TargetElements[id] = total
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, id := range pending {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed || d.Stop {
+			break
+		}
+		ids <- id
+	}
+	close(ids)
+	wg.Wait()
+
+	// keep what was scanned, even when a target failed
+	if err := d.PersistConfig(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if d.Stop {
+		return ErrStopped
+	}
+
+	var total uint64
+	var empty int
+	for _, id := range d.ids {
+		total += d.TargetElements[id]
+		if d.TargetElements[id] == 0 {
+			empty++
+		}
+	}
+	d.TotalElements = total
+	d.prescanned = true
+	d.appendLog(INFO, fmt.Sprintf("Total Elements: %d across %d targets, %d of them empty",
+		total, d.totalIDsCount, empty))
+	return nil
+}
+
+// targetElements returns the total elements of a target, pre-scanned or asked now
+func (d *Downloader) targetElements(pageID uint64) (uint64, error) {
+	if total, ok := d.TargetElements[pageID]; ok {
+		return total, nil
+	}
+	return d.calculateTotalElementsForTargetPage(pageID)
+}
+
+// clone returns a copy of the client sharing its rate limits
+func (api *AudistoAPIClient) clone() *AudistoAPIClient {
+	client := *api
+	return &client
+}
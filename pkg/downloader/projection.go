@@ -0,0 +1,262 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultSampleSeed the seed picking the sampled rows when not set, so the same
+	// download always gives the same sample
+	DefaultSampleSeed = 1
+
+	// SampleBlockRows the number of consecutive rows sampled together when sampling chunks
+	SampleBlockRows = 1000
+)
+
+// projectionError the columns or the condition don't fit the downloaded header, which
+// requesting the chunk again won't fix
+type projectionError struct {
+	err error
+}
+
+func (e *projectionError) Error() string {
+	return e.err.Error()
+}
+
+// prepareRows resolves the selected columns and the row condition against the header
+func (d *Downloader) prepareRows() error {
+	header := strings.Split(d.Header, "\t")
+	d.headerColumns = len(header)
+
+	d.projection = nil
+	for _, column := range d.Columns {
+		index := indexOf(header, column)
+		if index < 0 {
+			return &projectionError{fmt.Errorf("unknown column %q; the available columns are: %s",
+				column, strings.Join(header, ", "))}
+		}
+		d.projection = append(d.projection, index)
+	}
+
+	if d.where != nil {
+		if err := d.where.bind(header); err != nil {
+			return &projectionError{err}
+		}
+	}
+
+	d.pageColumn = indexOf(header, "id")
+	if d.pages != nil && d.pageColumn < 0 {
+		return &projectionError{fmt.Errorf("the rows have no id column to keep the pages of the earlier stage")}
+	}
+
+	// the rows of OnBatch are decoded according to the new header
+	d.decoder = nil
+	return nil
+}
+
+// outputHeader returns the header as written to the output, with the selected columns only
+func (d *Downloader) outputHeader() string {
+	if d.OutputDir != "" {
+		return targetsIndexHeader
+	}
+	return d.rowsHeader()
+}
+
+// rowsHeader returns the header of the written rows, with the selected columns and the
+// page ID of the target
+func (d *Downloader) rowsHeader() string {
+	header := d.Header
+	if d.projection != nil {
+		header = strings.Join(d.Columns, "\t")
+	}
+	if d.hasTargetColumn() {
+		header = TargetColumnName + "\t" + header
+	}
+	return header
+}
+
+// transformRow applies the sampling, the row condition, the pages of the earlier stage
+// and the column selection to the row at the given position, it returns false when the
+// row is filtered out. A row whose page ID isn't a number is left out as an anomaly.
+func (d *Downloader) transformRow(row []byte, position uint64) ([]byte, bool, error) {
+	if !d.sampled(position) {
+		return nil, false, nil
+	}
+	if d.where == nil && d.projection == nil && d.pages == nil {
+		return row, true, nil
+	}
+
+	fields := strings.Split(string(row), "\t")
+	if d.where != nil && !d.where.Match(fields) {
+		return nil, false, nil
+	}
+	if d.pages != nil {
+		id, err := strconv.ParseUint(fields[d.pageColumn], 10, 64)
+		if err != nil {
+			return nil, false, d.recordAnomaly(AnomalyType, fmt.Sprintf("row %d was left out, its page ID %q is not a number",
+				position+1, fields[d.pageColumn]))
+		}
+		if !d.pages[id] {
+			return nil, false, nil
+		}
+	}
+	if d.projection == nil {
+		return row, true, nil
+	}
+
+	var projected bytes.Buffer
+	for i, index := range d.projection {
+		if i > 0 {
+			projected.WriteByte('\t')
+		}
+		projected.WriteString(fields[index])
+	}
+	return projected.Bytes(), true, nil
+}
+
+// setupRows prepares the sampling and parses the row condition, the options being
+// already validated
+func (d *Downloader) setupRows() error {
+	if d.isSampled() && d.SampleSeed == 0 {
+		d.SampleSeed = DefaultSampleSeed
+	}
+	if d.isSampled() && d.SampleChunks && d.client.ChunkSize > SampleBlockRows {
+		// only the sampled blocks are requested
+		d.client.SetChunkSize(SampleBlockRows)
+	}
+
+	d.where = nil
+	if d.Where != "" {
+		where, err := ParseExpression(d.Where)
+		if err != nil {
+			return err
+		}
+		d.where = where
+	}
+	return nil
+}
+
+// selection describes which rows and columns are written, to make sure a download
+// is resumed with the same ones
+func (d *Downloader) selection() string {
+	var flags []string
+	if d.Format == FormatJSON {
+		flags = append(flags, "--format=json")
+	}
+	if len(d.Columns) > 0 {
+		flags = append(flags, fmt.Sprintf("--columns=%s", strings.Join(d.Columns, ",")))
+	}
+	if d.Where != "" {
+		flags = append(flags, fmt.Sprintf("--where=%q", d.Where))
+	}
+	if d.RowOffset > 0 {
+		flags = append(flags, fmt.Sprintf("--offset=%d", d.RowOffset))
+	}
+	if d.RowLimit > 0 {
+		flags = append(flags, fmt.Sprintf("--limit=%d", d.RowLimit))
+	}
+	if d.TargetColumn {
+		flags = append(flags, "--target-column")
+	}
+	if d.Outgoing {
+		flags = append(flags, "--outgoing")
+	}
+	if d.OutputDir != "" {
+		flags = append(flags, fmt.Sprintf("--output-dir=%q --output-template=%q", d.OutputDir, d.OutputTemplate))
+	}
+	if d.isSampled() {
+		flags = append(flags, fmt.Sprintf("--sample=%v --sample-seed=%d", d.Sample, d.SampleSeed))
+		if d.SampleChunks {
+			flags = append(flags, "--sample-chunks")
+		}
+	}
+	if len(flags) == 0 {
+		return "all rows and columns"
+	}
+	return strings.Join(flags, " ")
+}
+
+// clearSelection resets the row and column selection, before reading it from the resume file
+func (d *Downloader) clearSelection() {
+	d.Format = ""
+	d.Columns, d.Where = nil, ""
+	d.RowOffset, d.RowLimit = 0, 0
+	d.Sample, d.SampleSeed, d.SampleChunks = 0, 0, false
+	d.TargetColumn, d.Outgoing = false, false
+	d.OutputDir, d.OutputTemplate = "", ""
+}
+
+// rowRange returns the position of the first server row to download, and of the row
+// following the last one, out of the total number of rows
+func (d *Downloader) rowRange(total uint64) (start, end uint64) {
+	start, end = d.RowOffset, total
+	if start > total {
+		start = total
+	}
+	if d.RowLimit > 0 && start+d.RowLimit < end {
+		end = start + d.RowLimit
+	}
+	return start, end
+}
+
+func (d *Downloader) isSampled() bool {
+	return d.Sample > 0 && d.Sample < 1
+}
+
+// sampled tells whether the row at the given position is part of the sample. Rows are
+// picked by hashing their position (or the one of their block) along with the seed,
+// so a resumed download goes on with the same sample.
+func (d *Downloader) sampled(position uint64) bool {
+	if !d.isSampled() {
+		return true
+	}
+	unit := position
+	if d.SampleChunks {
+		unit = position / SampleBlockRows
+	}
+	value := mix64(uint64(d.SampleSeed) ^ mix64(unit))
+	// the 53 high bits make a uniform float in [0, 1)
+	return float64(value>>11)/(1<<53) < d.Sample
+}
+
+// skipUnsampled moves the current target past the blocks left out of the sample, so
+// they are not requested at all
+func (d *Downloader) skipUnsampled() {
+	if !d.isSampled() || !d.SampleChunks {
+		return
+	}
+	for !d.isDone() && !d.sampled(d.CurrentTarget.DoneElements) {
+		next := (d.CurrentTarget.DoneElements/SampleBlockRows + 1) * SampleBlockRows
+		if next > d.CurrentTarget.TotalElements {
+			next = d.CurrentTarget.TotalElements
+		}
+		d.DoneElements += next - d.CurrentTarget.DoneElements
+		d.CurrentTarget.Skipped += next - d.CurrentTarget.DoneElements
+		d.CurrentTarget.DoneElements = next
+		// the rows preceding the next chunk were not downloaded
+		d.CurrentTarget.LastRow = ""
+	}
+}
+
+// sampledRows turns the positions reached in the current target into rows downloaded.
+// The blocks left out of the sample are not downloaded, of the rows left only the
+// sampled share is expected to be.
+func (d *Downloader) sampledRows(total, done uint64) (uint64, uint64) {
+	if !d.isSampled() || !d.SampleChunks || done > total {
+		return total, done
+	}
+	remaining := uint64(float64(total-done) * d.Sample)
+	done -= d.CurrentTarget.Skipped
+	return done + remaining, done
+}
+
+// mix64 the splitmix64 finalizer, spreading sequential numbers over the whole range
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
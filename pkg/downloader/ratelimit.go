@@ -0,0 +1,209 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLimitWait the longest a limiter sleeps at once, so a new rate applies quickly
+const maxLimitWait = 100 * time.Millisecond
+
+// tokenBucket hands out tokens at a rate per second, allowing bursts of up to burst
+// tokens. A rate of 0 means no limit. The rate can be changed while tokens are waited for.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// setRate changes the rate and the burst of the bucket
+func (b *tokenBucket) setRate(rate, burst float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// a new bucket starts full
+	full := b.last.IsZero()
+	b.refill(time.Now())
+	b.rate, b.burst = rate, burst
+	if b.tokens > burst || full {
+		b.tokens = burst
+	}
+}
+
+// refill adds the tokens earned since the last call
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate > 0 && !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// take takes n tokens, waiting until the bucket is out of debt or ctx is done. Taking
+// more tokens than the burst is allowed, the wait is only longer.
+func (b *tokenBucket) take(ctx context.Context, n float64) error {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	b.refill(time.Now())
+	b.tokens -= n
+	b.mu.Unlock()
+
+	for {
+		b.mu.Lock()
+		if b.rate <= 0 {
+			// the limit was lifted, forget the debt
+			b.tokens = b.burst
+			b.mu.Unlock()
+			return nil
+		}
+		b.refill(time.Now())
+		if b.tokens >= 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		if wait > maxLimitWait {
+			wait = maxLimitWait
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// rateLimits the limits of an AudistoAPIClient, shared with the readers of the responses
+type rateLimits struct {
+	bandwidth tokenBucket
+	requests  tokenBucket
+
+	maxRate     int64
+	maxRequests int64
+	// received the bytes read from the responses, as sent by the server
+	received int64
+}
+
+// setMaxRate limits the bytes read per second, 0 lifts the limit
+func (l *rateLimits) setMaxRate(bytesPerSecond int64) {
+	atomic.StoreInt64(&l.maxRate, bytesPerSecond)
+	// a second worth of bytes can be read at once
+	l.bandwidth.setRate(float64(bytesPerSecond), float64(bytesPerSecond))
+}
+
+// setMaxRequestsPerMinute limits the requests made per minute, 0 lifts the limit
+func (l *rateLimits) setMaxRequestsPerMinute(requests int) {
+	atomic.StoreInt64(&l.maxRequests, int64(requests))
+	// the requests are spread evenly over the minute
+	l.requests.setRate(float64(requests)/60, 1)
+}
+
+// limitedBody reads a response body within the bandwidth limit, counting the bytes read
+type limitedBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	limits *rateLimits
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&b.limits.received, int64(n))
+		if waitErr := b.limits.bandwidth.take(b.ctx, float64(n)); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// SetMaxRate limits the bytes per second read from the API, 0 lifts the limit. It can
+// be called while a download is running.
+func (api *AudistoAPIClient) SetMaxRate(bytesPerSecond int64) {
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+	api.rateLimits().setMaxRate(bytesPerSecond)
+}
+
+// SetMaxRequestsPerMinute limits the requests made to the API per minute, 0 lifts the
+// limit. It can be called while a download is running.
+func (api *AudistoAPIClient) SetMaxRequestsPerMinute(requests int) {
+	if requests < 0 {
+		requests = 0
+	}
+	api.rateLimits().setMaxRequestsPerMinute(requests)
+}
+
+// MaxRate returns the limit of bytes per second, 0 if there is none
+func (api *AudistoAPIClient) MaxRate() int64 {
+	return atomic.LoadInt64(&api.rateLimits().maxRate)
+}
+
+// MaxRequestsPerMinute returns the limit of requests per minute, 0 if there is none
+func (api *AudistoAPIClient) MaxRequestsPerMinute() int {
+	return int(atomic.LoadInt64(&api.rateLimits().maxRequests))
+}
+
+// ReceivedBytes returns the bytes read from the responses so far, before they are
+// decompressed
+func (api *AudistoAPIClient) ReceivedBytes() int64 {
+	return atomic.LoadInt64(&api.rateLimits().received)
+}
+
+// rateLimits returns the limits of the client, created along with it by NewClient
+func (api *AudistoAPIClient) rateLimits() *rateLimits {
+	if api.limits == nil {
+		api.limits = &rateLimits{}
+	}
+	return api.limits
+}
+
+// SetLimits changes the rate limits of the download, 0 lifting a limit. It can be called
+// while the download is running, e.g. from the web interface.
+func (d *Downloader) SetLimits(bytesPerSecond int64, requestsPerMinute int) error {
+	if bytesPerSecond < 0 || requestsPerMinute < 0 {
+		return fmt.Errorf("the rate limits have to be positive")
+	}
+	if d.client == nil {
+		return fmt.Errorf("the download is not set up")
+	}
+	d.client.SetMaxRate(bytesPerSecond)
+	d.client.SetMaxRequestsPerMinute(requestsPerMinute)
+	d.appendLog(INFO, fmt.Sprintf("Rate limits set to %d bytes per second and %d requests per minute (0 is no limit)",
+		bytesPerSecond, requestsPerMinute))
+	return nil
+}
+
+// limitedETA returns the least time the remaining rows take within the rate limits, 0
+// without limits. The bandwidth needed per row is learnt from the rows received so far.
+func (d *Downloader) limitedETA(remaining uint64) time.Duration {
+	if remaining == 0 || d.client == nil {
+		return 0
+	}
+	var eta float64
+	if requests := d.client.MaxRequestsPerMinute(); requests > 0 && d.client.ChunkSize > 0 {
+		chunks := math.Ceil(float64(remaining) / float64(d.client.ChunkSize))
+		eta = chunks * 60 / float64(requests)
+	}
+	rows := atomic.LoadUint64(&d.receivedRows)
+	if rate := d.client.MaxRate(); rate > 0 && rows > 0 {
+		bytesPerRow := float64(d.client.ReceivedBytes()) / float64(rows)
+		eta = math.Max(eta, float64(remaining)*bytesPerRow/float64(rate))
+	}
+	return time.Duration(eta * float64(time.Second))
+}
@@ -0,0 +1,75 @@
+package downloader
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+const (
+	// DefaultMaxLineLength the maximum length in bytes of a single row if not explicitly set
+	DefaultMaxLineLength = 1024 * 1024
+
+	// maxPartialChunks the number of consecutive chunks cut off mid-body we tolerate
+	// before giving up on the connection
+	maxPartialChunks = 5
+)
+
+// ErrLineTooLong is returned when a row is longer than the maximum line length
+var ErrLineTooLong = errors.New("row exceeds the maximum line length")
+
+// rowReader iterates over the rows of a chunk as they are streamed from the API.
+// Unlike bufio.Scanner, it never hands out the partial row that remains when
+// the connection drops in the middle of a chunk.
+type rowReader struct {
+	reader    *bufio.Reader
+	maxLength int
+	line      []byte
+}
+
+func newRowReader(r io.Reader, maxLength int) *rowReader {
+	if maxLength <= 0 {
+		maxLength = DefaultMaxLineLength
+	}
+	return &rowReader{reader: bufio.NewReader(r), maxLength: maxLength}
+}
+
+// next returns the next complete row without its line break. The returned slice is
+// only valid until the next call. io.EOF is returned once the chunk has been read
+// completely, any other error means the chunk was cut off.
+func (r *rowReader) next() ([]byte, error) {
+	r.line = r.line[:0]
+	for {
+		fragment, err := r.reader.ReadSlice('\n')
+		r.line = append(r.line, fragment...)
+		if len(r.line) > r.maxLength {
+			return nil, ErrLineTooLong
+		}
+
+		switch err {
+		case nil:
+			return trimLineBreak(r.line), nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(r.line) == 0 {
+				return nil, io.EOF
+			}
+			// the last row of a chunk is not necessarily followed by a line break
+			return trimLineBreak(r.line), nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// trimLineBreak removes the trailing "\n" or "\r\n" of a line
+func trimLineBreak(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+	}
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line
+}
@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+// OutputS3 rows uploaded to S3-compatible object storage, as TSV
+const OutputS3 = "s3"
+
+// Part sizes of S3 multipart uploads
+const (
+	// MinS3PartSize the minimum size S3 accepts for every part but the last one
+	MinS3PartSize = 5 * 1024 * 1024
+	// DefaultS3PartSize the size of the uploaded parts when not set
+	DefaultS3PartSize = 16 * 1024 * 1024
+)
+
+// S3Config where and how to upload the output to S3-compatible object storage
+type S3Config struct {
+	// Endpoint e.g. s3.amazonaws.com or localhost:9000 for a local MinIO
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	Bucket   string `json:"bucket" yaml:"bucket"`
+	// Prefix prepended to the name of the output to build the object key
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	// Region of the bucket, looked up if not set
+	Region    string `json:"region,omitempty" yaml:"region,omitempty"`
+	AccessKey string `json:"accessKey,omitempty" yaml:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty" yaml:"secretKey,omitempty"`
+	// Insecure talk plain HTTP to the endpoint
+	Insecure bool `json:"insecure,omitempty" yaml:"insecure,omitempty"`
+	// PartSize the size of the uploaded parts, DefaultS3PartSize if not set
+	PartSize int64 `json:"partSize,omitempty" yaml:"partSize,omitempty"`
+}
+
+// UploadState keeps track of a multipart upload, persisted in the resume file
+type UploadState struct {
+	Key      string         `json:"key"`
+	UploadID string         `json:"uploadID"`
+	Parts    []UploadedPart `json:"parts"`
+	// DoneElements the number of downloaded elements held by the uploaded parts
+	DoneElements uint64 `json:"doneElements"`
+}
+
+// UploadedPart a completed part of a multipart upload
+type UploadedPart struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// objectKey returns the key of the uploaded object, the prefix followed by the output name
+func (c *S3Config) objectKey(output string) string {
+	prefix := strings.TrimPrefix(c.Prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + path.Base(output)
+}
+
+func (c *S3Config) partSize() int64 {
+	if c.PartSize <= 0 {
+		return DefaultS3PartSize
+	}
+	return c.PartSize
+}
+
+// validate checks the S3 settings are complete
+func (c *S3Config) validate() error {
+	if c.Endpoint == "" || c.Bucket == "" {
+		return fmt.Errorf("uploading to S3 requires an endpoint and a bucket")
+	}
+	if c.PartSize > 0 && c.PartSize < MinS3PartSize {
+		return fmt.Errorf("S3 parts have to be at least 5MiB")
+	}
+	return nil
+}
+
+// s3Output buffers rows and uploads them as the parts of a multipart upload. A part is
+// only uploaded after a whole chunk, so the parts always end on a chunk boundary and a
+// resumed download continues right after the last completed part.
+type s3Output struct {
+	core   minio.Core
+	bucket string
+	size   int64
+	buffer bytes.Buffer
+	state  *UploadState
+	d      *Downloader
+}
+
+// newS3Output starts a multipart upload, or continues the one of the resume file
+func newS3Output(d *Downloader, resume bool) (*s3Output, error) {
+	config := d.S3
+
+	var client *minio.Client
+	var err error
+	if config.Region != "" {
+		client, err = minio.NewWithRegion(config.Endpoint, config.AccessKey, config.SecretKey, !config.Insecure, config.Region)
+	} else {
+		client, err = minio.New(config.Endpoint, config.AccessKey, config.SecretKey, !config.Insecure)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	o := &s3Output{
+		core:   minio.Core{Client: client},
+		bucket: config.Bucket,
+		size:   config.partSize(),
+		d:      d,
+	}
+
+	if resume && d.Upload != nil && d.Upload.UploadID != "" {
+		// make sure the upload was neither completed nor aborted in the meantime
+		_, err := o.core.ListObjectParts(o.bucket, d.Upload.Key, d.Upload.UploadID, 0, 1)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resume the upload of %q: %v: use --no-resume to create new", d.Upload.Key, err)
+		}
+		o.state = d.Upload
+		return o, nil
+	}
+
+	key := config.objectKey(d.OutputFilename)
+	uploadID, err := o.core.NewMultipartUpload(o.bucket, key, minio.PutObjectOptions{
+		ContentType: "text/tab-separated-values",
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.Upload = &UploadState{Key: key, UploadID: uploadID}
+	o.state = d.Upload
+	return o, nil
+}
+
+func (o *s3Output) writeHeader(header []byte) error {
+	return o.writeRow(header)
+}
+
+func (o *s3Output) writeRow(row []byte) error {
+	o.buffer.Write(row)
+	return o.buffer.WriteByte('\n')
+}
+
+// flush uploads the buffered rows once they make up a whole part
+func (o *s3Output) flush() error {
+	if int64(o.buffer.Len()) < o.size {
+		return nil
+	}
+	return o.uploadPart()
+}
+
+func (o *s3Output) uploadPart() error {
+	number := len(o.state.Parts) + 1
+	size := int64(o.buffer.Len())
+	part, err := o.core.PutObjectPart(o.bucket, o.state.Key, o.state.UploadID, number,
+		bytes.NewReader(o.buffer.Bytes()), size, "", "", nil)
+	if err != nil {
+		return err
+	}
+
+	o.state.Parts = append(o.state.Parts, UploadedPart{Number: number, ETag: part.ETag, Size: size})
+	o.state.DoneElements = o.d.DoneElements
+	o.buffer.Reset()
+	return nil
+}
+
+// close uploads the remaining rows and completes the upload. An interrupted download
+// never gets here and leaves the upload open, to be continued when resuming.
+func (o *s3Output) close() error {
+	if o.buffer.Len() > 0 || len(o.state.Parts) == 0 {
+		if err := o.uploadPart(); err != nil {
+			return err
+		}
+	}
+
+	parts := make([]minio.CompletePart, len(o.state.Parts))
+	for i, part := range o.state.Parts {
+		parts[i] = minio.CompletePart{PartNumber: part.Number, ETag: part.ETag}
+	}
+	_, err := o.core.CompleteMultipartUpload(o.bucket, o.state.Key, o.state.UploadID, parts)
+	return err
+}
+
+// committedElements returns the number of downloaded elements held by the uploaded parts,
+// the rows downloaded after the last part are downloaded again.
+func (o *s3Output) committedElements() (uint64, bool, error) {
+	return o.state.DoneElements, true, nil
+}
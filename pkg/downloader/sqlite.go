@@ -0,0 +1,350 @@
+package downloader
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	// registers the "sqlite3" database/sql driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMetaTable the table holding the download metadata, next to the rows table
+const sqliteMetaTable = "download_meta"
+
+// sqliteOutput inserts rows into a table of a SQLite database, one transaction per chunk.
+// The table is created from the header, with column types inferred from the first chunk.
+// The download progress is committed along with the rows, so an interrupted download
+// resumes from what the database actually holds.
+type sqliteOutput struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	insert  *sql.Stmt
+	table   string
+	columns []string
+	types   []string
+	// rows of the first chunk, kept until the column types are inferred
+	pending [][]string
+	// rows in the table, including the uncommitted ones
+	rows int64
+	d    *Downloader
+}
+
+// newSQLiteOutput creates the database, or opens it when resuming. The rows go into a
+// table named after the download mode.
+func newSQLiteOutput(d *Downloader, resume bool) (*sqliteOutput, error) {
+	if !resume {
+		if err := os.Remove(d.OutputFilename); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open("sqlite3", d.OutputFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &sqliteOutput{db: db, table: d.client.Mode, d: d}
+	if o.table == "" {
+		o.table = "pages"
+	}
+
+	_, err = db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (key TEXT PRIMARY KEY, value TEXT)", sqliteMetaTable))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := o.setMeta(db, map[string]string{
+		"crawl_id": strconv.FormatUint(d.client.CrawlID, 10),
+		"mode":     d.client.Mode,
+		"filter":   d.client.Filter,
+		"order":    d.client.Order,
+		"details":  strconv.FormatBool(d.client.Deep),
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// the start of the very first run is kept across resumes
+	_, err = db.Exec(fmt.Sprintf("INSERT OR IGNORE INTO %s (key, value) VALUES ('started_at', ?)", sqliteMetaTable), now())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if resume && d.Header != "" {
+		if err := o.openTable(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// openTable prepares inserting into an existing table, created by a previous run
+func (o *sqliteOutput) openTable() error {
+	var count int
+	err := o.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", o.table).Scan(&count)
+	if err != nil || count == 0 {
+		// no rows were committed yet, the table is created along with the first chunk
+		return err
+	}
+
+	o.columns = strings.Split(o.d.outputHeader(), "\t")
+	rows, err := o.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", quoteIdentifier(o.table)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		o.types = append(o.types, columnType)
+	}
+	if len(o.types) != len(o.columns) {
+		return fmt.Errorf("table %q of %s does not match the header of the download", o.table, o.d.OutputFilename)
+	}
+
+	if err := o.db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(rowid), 0) FROM %s", quoteIdentifier(o.table))).Scan(&o.rows); err != nil {
+		return err
+	}
+	return o.prepareInsert()
+}
+
+// createTable creates the rows table, inferring the column types from the pending rows
+func (o *sqliteOutput) createTable() error {
+	o.types = inferColumnTypes(len(o.columns), o.pending)
+
+	definitions := make([]string, len(o.columns))
+	for i, column := range o.columns {
+		definitions[i] = quoteIdentifier(column) + " " + o.types[i]
+	}
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quoteIdentifier(o.table), strings.Join(definitions, ", "))
+	if _, err := o.db.Exec(query); err != nil {
+		return err
+	}
+	return o.prepareInsert()
+}
+
+func (o *sqliteOutput) prepareInsert() error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(o.columns)), ", ")
+	insert, err := o.db.Prepare(fmt.Sprintf("INSERT INTO %s VALUES (%s)", quoteIdentifier(o.table), placeholders))
+	if err != nil {
+		return err
+	}
+	o.insert = insert
+	return nil
+}
+
+func (o *sqliteOutput) begin() error {
+	if o.tx != nil {
+		return nil
+	}
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
+	o.tx = tx
+	return nil
+}
+
+func (o *sqliteOutput) writeHeader(header []byte) error {
+	columns := strings.Split(string(header), "\t")
+	if o.insert != nil && len(columns) != len(o.columns) {
+		return fmt.Errorf("table %q already exists with %d columns", o.table, len(o.columns))
+	}
+	o.columns = columns
+	return nil
+}
+
+func (o *sqliteOutput) writeRow(row []byte) error {
+	fields := strings.Split(string(row), "\t")
+	if o.insert == nil {
+		o.pending = append(o.pending, fields)
+		return nil
+	}
+	return o.insertRow(fields)
+}
+
+func (o *sqliteOutput) insertRow(fields []string) error {
+	if err := o.begin(); err != nil {
+		return err
+	}
+
+	values := make([]interface{}, len(o.columns))
+	for i := range values {
+		if i < len(fields) {
+			values[i] = columnValue(o.types[i], fields[i])
+		}
+	}
+	if _, err := o.tx.Stmt(o.insert).Exec(values...); err != nil {
+		return err
+	}
+	o.rows++
+	return nil
+}
+
+// flush commits the rows of the chunk along with the download progress
+func (o *sqliteOutput) flush() error {
+	if o.insert == nil && len(o.pending) > 0 {
+		if err := o.createTable(); err != nil {
+			return err
+		}
+		for _, fields := range o.pending {
+			if err := o.insertRow(fields); err != nil {
+				return err
+			}
+		}
+		o.pending = nil
+	}
+
+	if err := o.begin(); err != nil {
+		return err
+	}
+	err := o.setMeta(o.tx, map[string]string{
+		"done_elements":  strconv.FormatUint(o.d.DoneElements, 10),
+		"total_elements": strconv.FormatUint(o.d.TotalElements, 10),
+		"rows":           strconv.FormatInt(o.rows, 10),
+		"header":         o.d.outputHeader(),
+		"updated_at":     now(),
+	})
+	if err != nil {
+		o.tx.Rollback()
+		o.tx = nil
+		return err
+	}
+
+	err = o.tx.Commit()
+	o.tx = nil
+	return err
+}
+
+func (o *sqliteOutput) close() error {
+	if err := o.flush(); err != nil {
+		o.db.Close()
+		return err
+	}
+	if o.d.isDone() {
+		if err := o.setMeta(o.db, map[string]string{"completed_at": now()}); err != nil {
+			o.db.Close()
+			return err
+		}
+	}
+	return o.db.Close()
+}
+
+// committedElements returns the number of elements (server rows) downloaded, as committed along with the rows
+func (o *sqliteOutput) committedElements() (uint64, bool, error) {
+	var value string
+	err := o.db.QueryRow(fmt.Sprintf("SELECT value FROM %s WHERE key = 'done_elements'", sqliteMetaTable)).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	done, err := strconv.ParseUint(value, 10, 64)
+	return done, err == nil, err
+}
+
+func (o *sqliteOutput) offset() int64 {
+	return o.rows
+}
+
+// rewind deletes the rows inserted after the given number of rows
+func (o *sqliteOutput) rewind(offset int64) error {
+	o.pending = nil
+	if o.insert == nil {
+		return nil
+	}
+	if err := o.begin(); err != nil {
+		return err
+	}
+	if _, err := o.tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE rowid > ?", quoteIdentifier(o.table)), offset); err != nil {
+		return err
+	}
+	o.rows = offset
+	return nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (o *sqliteOutput) setMeta(db execer, values map[string]string) error {
+	query := fmt.Sprintf("INSERT OR REPLACE INTO %s (key, value) VALUES (?, ?)", sqliteMetaTable)
+	for key, value := range values {
+		if _, err := db.Exec(query, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inferColumnTypes picks INTEGER or REAL for the columns whose (non empty) values all
+// are numbers, TEXT otherwise
+func inferColumnTypes(columns int, rows [][]string) []string {
+	types := make([]string, columns)
+	for i := range types {
+		types[i] = "INTEGER"
+		seen := false
+		for _, fields := range rows {
+			if i >= len(fields) || fields[i] == "" {
+				continue
+			}
+			seen = true
+			if types[i] == "INTEGER" {
+				if _, err := strconv.ParseInt(fields[i], 10, 64); err == nil {
+					continue
+				}
+				types[i] = "REAL"
+			}
+			if _, err := strconv.ParseFloat(fields[i], 64); err != nil {
+				types[i] = "TEXT"
+				break
+			}
+		}
+		if !seen {
+			types[i] = "TEXT"
+		}
+	}
+	return types
+}
+
+// columnValue converts a TSV field to the type of its column. Values that don't fit
+// are stored as text, which SQLite allows.
+func columnValue(columnType, field string) interface{} {
+	switch columnType {
+	case "INTEGER":
+		if field == "" {
+			return nil
+		}
+		if value, err := strconv.ParseInt(field, 10, 64); err == nil {
+			return value
+		}
+	case "REAL":
+		if field == "" {
+			return nil
+		}
+		if value, err := strconv.ParseFloat(field, 64); err == nil {
+			return value
+		}
+	}
+	return field
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,6 @@
+// +build !cgo
+
+package downloader
+
+// sqliteSupported the SQLite driver is a cgo package, it only works in binaries built with cgo
+var sqliteSupported = false
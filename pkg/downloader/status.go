@@ -1,21 +1,18 @@
 package downloader
 
 import (
+	"math"
 	"math/big"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	// ETAFactor ETA milliseconds estimation factor
-	ETAFactor = 175
-)
-
 // progress bar elements
 var (
-	timeoutCount int
-	errorCount   int
-
-	averageTimePer1000 float64 = 1
+	// timeoutCount and errorCount are shared by the target workers, they are only
+	// accessed atomically
+	timeoutCount int64
+	errorCount   int64
 
 	// RefreshInterval time between to progress updates
 	// Export so the caller can fine-tune this
@@ -24,17 +21,31 @@ var (
 
 // StatusReport a struct holding the progress status of the current download
 type StatusReport struct {
-	ETA                         time.Duration
+	// ETA of the whole download, across the targets and the stages of --targets=self,
+	// TargetETA of the current target. Both are 0 until the first chunk is received.
+	ETA, TargetETA time.Duration
+	// Elapsed the time since the download started, RowsPerSecond and BytesPerSecond
+	// the recent throughput
+	Elapsed                     time.Duration
+	RowsPerSecond               float64
+	BytesPerSecond              float64
 	ChunkSize                   uint64
 	TotalElements, DoneElements uint64
 	Mode                        string
 	TimeoutsCount, ErrorsCount  int
 	ProgressPercentage          float64
 	OutputFilename              string
-	Logs                        []map[LogType]string
 	IsIngTargetMode             bool
 	TotalIDsCount               int
 	CurrentIDOrderNumber        int
+	Anomalies                   []Anomaly
+	// OverallTotalElements and OverallDoneElements the rows of all the targets, once
+	// pre-scanned, 0 otherwise
+	OverallTotalElements, OverallDoneElements uint64
+	OverallPercentage                         float64
+	// MaxRate (bytes per second) and MaxRequestsPerMinute the rate limits, 0 if none
+	MaxRate              int64
+	MaxRequestsPerMinute int
 }
 
 // IsDone a helper function to know if the download is considered done.
@@ -65,33 +76,60 @@ func reportProgressStatus(downloader *Downloader) {
 
 // ProgressReport make the downloader tell its current status
 func (d *Downloader) ProgressReport() StatusReport {
+	// progress of the rows to download, rather than of the positions of the server rows
+	var current currentTarget
+	var overallDone uint64
+	var finished int
+	var anomalies []Anomaly
+	if d.isInTargetsMode() && d.currentTargetsFilename != "self" {
+		// the first target being downloaded by the workers
+		progress := d.targetsProgress()
+		current, overallDone, finished, anomalies = progress.current(), progress.done, progress.finished, progress.anomalies
+	} else {
+		current, overallDone, finished, anomalies = d.CurrentTarget, d.DoneElements, d.TargetsFileNextID, d.Anomalies
+	}
+	total, done := current.TotalElements, current.DoneElements
+	if !d.isInTargetsMode() && done >= d.RowOffset && total >= d.RowOffset {
+		total, done = d.sampledRows(total-d.RowOffset, done-d.RowOffset)
+	}
 
-	// Calculate Estimated Time of Arival
-	ETAuint64, _ := big.NewFloat(0).Quo(big.NewFloat(0).Quo(big.NewFloat(0).Sub(big.NewFloat(0).SetUint64(d.CurrentTarget.TotalElements), big.NewFloat(0).SetUint64(d.CurrentTarget.DoneElements)), big.NewFloat(1000)), big.NewFloat(averageTimePer1000)).Uint64()
+	eta, targetETA := d.estimate()
+	rows, bytes, _ := d.speed.rates()
 
 	// Calculate the progress percentage
 	var progressPerc *big.Float = big.NewFloat(0.0)
 	var progressF float64
-	if d.CurrentTarget.TotalElements > 0 && d.CurrentTarget.DoneElements > 0 {
-		progressPerc = big.NewFloat(0).Quo(big.NewFloat(100), big.NewFloat(0).Quo(big.NewFloat(0).SetUint64(d.CurrentTarget.TotalElements), big.NewFloat(0).SetUint64(d.CurrentTarget.DoneElements)))
+	if total > 0 && done > 0 {
+		progressPerc = big.NewFloat(0).Quo(big.NewFloat(100), big.NewFloat(0).Quo(big.NewFloat(0).SetUint64(total), big.NewFloat(0).SetUint64(done)))
 		progressF, _ = progressPerc.Float64()
 	}
 
-	return StatusReport{
-		ETA:                  time.Duration(ETAuint64) * time.Millisecond * ETAFactor,
+	report := StatusReport{
+		ETA:                  eta,
+		TargetETA:            targetETA,
+		Elapsed:              d.speed.elapsed(time.Now()).Round(time.Second),
+		RowsPerSecond:        rows,
+		BytesPerSecond:       bytes,
 		Mode:                 d.client.Mode,
 		ChunkSize:            d.client.ChunkSize,
-		TotalElements:        d.CurrentTarget.TotalElements,
-		DoneElements:         d.CurrentTarget.DoneElements,
-		TimeoutsCount:        timeoutCount,
-		ErrorsCount:          errorCount,
+		TotalElements:        total,
+		DoneElements:         done,
+		TimeoutsCount:        int(atomic.LoadInt64(&timeoutCount)),
+		ErrorsCount:          int(atomic.LoadInt64(&errorCount)),
 		ProgressPercentage:   progressF,
-		Logs:                 d.logs,
 		OutputFilename:       d.OutputFilename,
 		IsIngTargetMode:      d.isInTargetsMode() && d.currentTargetsFilename != "self",
-		CurrentIDOrderNumber: d.TargetsFileNextID,
+		CurrentIDOrderNumber: finished,
 		TotalIDsCount:        d.totalIDsCount,
+		Anomalies:            anomalies,
+		MaxRate:              d.client.MaxRate(),
+		MaxRequestsPerMinute: d.client.MaxRequestsPerMinute(),
+	}
+	if d.prescanned && d.TotalElements > 0 {
+		report.OverallTotalElements, report.OverallDoneElements = d.TotalElements, overallDone
+		report.OverallPercentage = math.Min(100, float64(overallDone)*100/float64(d.TotalElements))
 	}
+	return report
 }
 
 func (d *Downloader) closeStatusChannel() {
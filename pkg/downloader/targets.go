@@ -0,0 +1,519 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultTargetWorkers the number of targets downloaded at once when not set, see
+	// Downloader.TargetWorkers
+	DefaultTargetWorkers = 4
+
+	// TargetColumnName the column holding the page ID of the target, see Downloader.TargetColumn
+	TargetColumnName = "target_page_id"
+
+	// DefaultOutputTemplate names the file of a target with Downloader.OutputDir. {target}
+	// is replaced with the page ID of the target, {index} with its position among the targets,
+	// {crawl} and {mode} with the ones of the download.
+	DefaultOutputTemplate = "{target}.tsv"
+
+	// TargetsIndexFilename the output listing the files of the targets in Downloader.OutputDir,
+	// unless an output is set
+	TargetsIndexFilename = "targets-index.tsv"
+
+	// targetsIndexHeader the header of the output listing the files of the targets
+	targetsIndexHeader = TargetColumnName + "\tfilename\trows"
+)
+
+// targetResult a target downloaded by a worker
+type targetResult struct {
+	index    int
+	elements uint64
+	// header the header of the target's chunks, empty if it had no rows
+	header    string
+	anomalies []Anomaly
+	err       error
+}
+
+// downloadTargets downloads the targets of the targets file with a pool of workers. Each
+// worker writes the rows of its target to a buffer file; the buffers are appended to the
+// output in the order of the targets file, as soon as the targets before them are done.
+// A target that was not completed is downloaded again from its beginning when resuming.
+func (d *Downloader) downloadTargets() error {
+	if err := d.resumeTargets(); err != nil {
+		return err
+	}
+	if !d.canResume() {
+		dir, err := ioutil.TempDir("", "audisto-targets")
+		if err != nil {
+			return err
+		}
+		d.bufferDir = dir
+		defer func() {
+			os.RemoveAll(dir)
+			d.bufferDir = ""
+		}()
+	}
+	// the buffers completed by a previous run go first
+	if err := d.appendTargets(); err != nil {
+		return err
+	}
+
+	var pending []int
+	for index := d.TargetsFileNextID; index < d.totalIDsCount; index++ {
+		if _, ok := d.CompletedTargets[index]; !ok {
+			pending = append(pending, index)
+		}
+	}
+
+	workers := d.TargetWorkers
+	if workers <= 0 {
+		workers = DefaultTargetWorkers
+	}
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+
+	d.workersMu.Lock()
+	d.running = make(map[int]currentTarget)
+	d.workersMu.Unlock()
+	d.abort = make(chan struct{})
+	jobs := make(chan int)
+	results := make(chan *targetResult)
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for index := range jobs {
+				results <- d.downloadTargetAt(index)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, index := range pending {
+			if d.Stop {
+				return
+			}
+			select {
+			case jobs <- index:
+			case <-d.abort:
+				return
+			}
+		}
+	}()
+	go func() {
+		for i := 0; i < workers; i++ {
+			<-done
+		}
+		close(results)
+	}()
+
+	// the first failure stops the other workers, the targets they completed are kept
+	var failure error
+	fail := func(err error) {
+		if failure == nil {
+			failure = err
+			close(d.abort)
+		}
+	}
+	for result := range results {
+		if result.err != nil {
+			fail(result.err)
+			continue
+		}
+		if err := d.completeTarget(result); err != nil {
+			fail(err)
+			continue
+		}
+		if failure == nil {
+			if err := d.appendTargets(); err != nil {
+				fail(err)
+			}
+		}
+	}
+
+	if failure != nil {
+		d.PersistConfig()
+		return failure
+	}
+	if d.Stop && d.TargetsFileNextID < d.totalIDsCount {
+		return ErrStopped
+	}
+	return nil
+}
+
+// resumeTargets drops from the output the rows written after the last target appended
+// to it, and forgets the completed targets whose buffer went missing
+func (d *Downloader) resumeTargets() error {
+	if output, ok := d.out.(rewinder); ok && output.offset() > d.CurrentTarget.Offset {
+		if err := output.rewind(d.CurrentTarget.Offset); err != nil {
+			return err
+		}
+		if d.CurrentTarget.Offset == 0 {
+			d.Header = ""
+			d.headerColumns = 0
+		}
+	}
+
+	var missing []int
+	for index, elements := range d.CompletedTargets {
+		if elements > 0 && fExists(d.targetBuffer(index)) != nil {
+			missing = append(missing, index)
+		}
+	}
+	sort.Ints(missing)
+
+	d.workersMu.Lock()
+	if d.CurrentTarget.DoneElements > 0 {
+		// a target partially downloaded by an earlier version, it is downloaded again
+		d.DoneElements -= d.CurrentTarget.DoneElements
+	}
+	d.CurrentTarget = currentTarget{Offset: d.outputOffset()}
+	for _, index := range missing {
+		delete(d.CompletedTargets, index)
+	}
+	d.workersMu.Unlock()
+
+	for _, index := range missing {
+		d.appendLog(WARNING, fmt.Sprintf("The buffer of target %d is missing, downloading it again\n", index+1))
+	}
+	return nil
+}
+
+// downloadTargetAt downloads the target at index of the targets file into its buffer
+func (d *Downloader) downloadTargetAt(index int) *targetResult {
+	result := &targetResult{index: index}
+	pageID := d.ids[index]
+
+	w := d.newTargetWorker(index)
+	totalElements, err := w.targetElements(pageID)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	if totalElements == 0 {
+		// nothing to download
+		d.logger().Debug("target skipped", "target", pageID, "index", index)
+		return result
+	}
+	w.CurrentTarget.TotalElements = totalElements
+	if w.out, err = newFileOutput(w.OutputFilename, false); err != nil {
+		result.err = err
+		return result
+	}
+
+	d.workersMu.Lock()
+	d.running[index] = w.CurrentTarget
+	d.workersMu.Unlock()
+	defer func() {
+		d.workersMu.Lock()
+		delete(d.running, index)
+		d.workersMu.Unlock()
+	}()
+
+	target := TargetEvent{PageID: pageID, Index: index, Total: d.totalIDsCount, Elements: totalElements}
+	d.logger().Debug("target started", "target", pageID, "index", index, "elements", totalElements)
+	d.notify(func(o Observer) { o.OnTargetStart(target) })
+
+	err = w.downloadTarget()
+	if closeErr := w.out.close(); err == nil && closeErr != nil {
+		err = &writeError{closeErr}
+	}
+	if err != nil {
+		os.Remove(w.OutputFilename)
+		result.err = err
+		return result
+	}
+	d.notify(func(o Observer) { o.OnTargetDone(target) })
+
+	result.elements, result.header, result.anomalies = w.DoneElements, w.Header, w.Anomalies
+	return result
+}
+
+// newTargetWorker returns a downloader for the target at index, sharing the settings,
+// the rate limits and the observers of d, and writing to the buffer of the target
+func (d *Downloader) newTargetWorker(index int) *Downloader {
+	w := &Downloader{
+		OutputFilename:         d.targetBuffer(index),
+		TargetsFileNextID:      index,
+		TargetElements:         d.TargetElements,
+		Format:                 d.Format,
+		Columns:                d.Columns,
+		Where:                  d.Where,
+		MaxLineLength:          d.MaxLineLength,
+		Strict:                 d.Strict,
+		DriftCheck:             d.DriftCheck,
+		DriftInterval:          d.DriftInterval,
+		Logger:                 d.Logger,
+		currentTargetsFilename: d.currentTargetsFilename,
+		ids:                    d.ids,
+		totalIDsCount:          d.totalIDsCount,
+		client:                 d.client.clone(),
+		parent:                 d,
+	}
+	if d.OnBatch != nil {
+		// the batches of the targets are handed over one at a time, not in the targets order
+		w.OnBatch = func(batch interface{}) error {
+			d.eventsMu.Lock()
+			defer d.eventsMu.Unlock()
+			return d.OnBatch(batch)
+		}
+	}
+	w.client.ResetChunkSize()
+	w.client.SetTargetPageFilter(d.ids[index])
+	// the condition was validated along with the options
+	w.setupRows()
+	return w
+}
+
+// completeTarget keeps track of a target downloaded by a worker until it is appended.
+// The output gets its header from the first target completed.
+func (d *Downloader) completeTarget(result *targetResult) error {
+	if result.header != "" {
+		if err := d.checkHeader([]byte(result.header)); err != nil {
+			if err == errHeaderMismatch {
+				return fmt.Errorf("Target %d came with a different header than the previous targets", d.ids[result.index])
+			}
+			return err
+		}
+		if err := d.out.flush(); err != nil {
+			return &writeError{err}
+		}
+	}
+
+	d.workersMu.Lock()
+	if result.header != "" && d.DoneElements == 0 {
+		d.CurrentTarget.Offset = d.outputOffset()
+	}
+	if d.CompletedTargets == nil {
+		d.CompletedTargets = make(map[int]uint64)
+	}
+	d.CompletedTargets[result.index] = result.elements
+	d.Anomalies = append(d.Anomalies, result.anomalies...)
+	d.workersMu.Unlock()
+	return d.PersistConfig()
+}
+
+// appendTargets appends the buffers of the completed targets following the ones already
+// in the output
+func (d *Downloader) appendTargets() error {
+	for d.TargetsFileNextID < d.totalIDsCount {
+		index := d.TargetsFileNextID
+		elements, ok := d.CompletedTargets[index]
+		if !ok {
+			return nil
+		}
+		if err := d.writeTarget(index, elements); err != nil {
+			return err
+		}
+
+		d.workersMu.Lock()
+		delete(d.CompletedTargets, index)
+		d.TargetsFileNextID++
+		d.DoneElements += elements
+		d.CurrentTarget.Offset = d.outputOffset()
+		d.workersMu.Unlock()
+		if err := d.PersistConfig(); err != nil {
+			return err
+		}
+		os.Remove(d.targetBuffer(index))
+	}
+	return nil
+}
+
+// writeTarget appends the rows of the target at index to the output. With an output
+// directory they go to their own file instead, listed by the output; the targets without
+// any row get no file.
+func (d *Downloader) writeTarget(index int, elements uint64) error {
+	if elements == 0 {
+		return nil
+	}
+	if d.OutputDir == "" {
+		return d.copyBuffer(index, d.out, false)
+	}
+
+	filename := d.targetFilename(index)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return &writeError{err}
+	}
+	out, err := newFileOutput(filename, false)
+	if err != nil {
+		return &writeError{err}
+	}
+	if err := d.copyBuffer(index, out, true); err != nil {
+		out.close()
+		return err
+	}
+	if err := out.close(); err != nil {
+		return &writeError{err}
+	}
+
+	row := fmt.Sprintf("%d\t%s\t%d", d.ids[index], filename, elements)
+	if err := d.out.writeRow([]byte(row)); err != nil {
+		return &writeError{err}
+	}
+	if err := d.out.flush(); err != nil {
+		return &writeError{err}
+	}
+	return nil
+}
+
+// copyBuffer writes the rows of the buffer of the target at index to out, along with the
+// header of the buffer if asked to. The page ID of the target is prepended with TargetColumn.
+func (d *Downloader) copyBuffer(index int, out rowWriter, withHeader bool) error {
+	file, err := os.Open(d.targetBuffer(index))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for header := true; ; header = false {
+		row, err := reader.ReadBytes('\n')
+		if len(row) > 0 && (withHeader || !header) {
+			row = bytes.TrimSuffix(row, []byte("\n"))
+			if d.hasTargetColumn() {
+				column := strconv.FormatUint(d.ids[index], 10)
+				if header {
+					column = TargetColumnName
+				}
+				row = append([]byte(column+"\t"), row...)
+			}
+			write := out.writeRow
+			if header {
+				write = out.writeHeader
+			}
+			if err := write(row); err != nil {
+				return &writeError{err}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := out.flush(); err != nil {
+		return &writeError{err}
+	}
+	return nil
+}
+
+// targetFilename returns the path of the file of the target at index in the output directory
+func (d *Downloader) targetFilename(index int) string {
+	name := strings.NewReplacer(
+		"{target}", strconv.FormatUint(d.ids[index], 10),
+		"{index}", strconv.Itoa(index+1),
+		"{crawl}", strconv.FormatUint(d.client.CrawlID, 10),
+		"{mode}", d.client.Mode,
+	).Replace(d.OutputTemplate)
+	return filepath.Join(d.OutputDir, name)
+}
+
+// hasTargetColumn tells whether the rows get the page ID of their target, only the targets
+// of a targets file have one
+func (d *Downloader) hasTargetColumn() bool {
+	return d.TargetColumn && d.isInTargetsMode() && d.currentTargetsFilename != "self"
+}
+
+// targetBuffer returns the path of the file buffering the rows of the target at index,
+// next to the resume file
+func (d *Downloader) targetBuffer(index int) string {
+	name := fmt.Sprintf(".target_%d", index)
+	if d.bufferDir != "" {
+		return filepath.Join(d.bufferDir, name[1:])
+	}
+	return strings.TrimSuffix(d.getResumeFilename(), "_") + name
+}
+
+// stopped tells whether the download was stopped, a target worker stops along with its
+// parent or after another worker failed
+func (d *Downloader) stopped() bool {
+	if d.Stop {
+		return true
+	}
+	if d.parent == nil {
+		return false
+	}
+	select {
+	case <-d.parent.abort:
+		return true
+	default:
+		return d.parent.Stop
+	}
+}
+
+// targetsProgress a view of the progress across the targets of a targets file
+type targetsProgress struct {
+	// running the targets being downloaded, by index
+	running map[int]currentTarget
+	// pending the indexes of the targets not started yet
+	pending []int
+	// done the elements downloaded across the targets, finished the number of targets done
+	done     uint64
+	finished int
+	// anomalies the ones of the targets completed
+	anomalies []Anomaly
+}
+
+// current returns the first target being downloaded, the one holding the output back
+func (p *targetsProgress) current() currentTarget {
+	var indexes []int
+	for index := range p.running {
+		indexes = append(indexes, index)
+	}
+	if len(indexes) == 0 {
+		return currentTarget{}
+	}
+	sort.Ints(indexes)
+	return p.running[indexes[0]]
+}
+
+// targetsProgress returns the progress across the targets, without a worker it is the one
+// of the current target
+func (d *Downloader) targetsProgress() targetsProgress {
+	d.workersMu.Lock()
+	defer d.workersMu.Unlock()
+
+	progress := targetsProgress{running: make(map[int]currentTarget), done: d.DoneElements,
+		finished: d.TargetsFileNextID + len(d.CompletedTargets), anomalies: d.Anomalies}
+	for index, target := range d.running {
+		progress.running[index] = target
+		progress.done += target.DoneElements
+	}
+	if len(d.running) == 0 && d.CurrentTarget.TotalElements > 0 {
+		// DoneElements already counts the current target
+		progress.running[d.TargetsFileNextID] = d.CurrentTarget
+	}
+	for index := d.TargetsFileNextID; index < d.totalIDsCount; index++ {
+		_, completed := d.CompletedTargets[index]
+		_, running := progress.running[index]
+		if !completed && !running {
+			progress.pending = append(progress.pending, index)
+		}
+	}
+	for _, elements := range d.CompletedTargets {
+		progress.done += elements
+	}
+	return progress
+}
+
+// followTarget keeps the progress of the target at index, while a worker downloads it
+func (d *Downloader) followTarget(index int, target currentTarget) {
+	d.workersMu.Lock()
+	defer d.workersMu.Unlock()
+	if _, ok := d.running[index]; ok {
+		d.running[index] = target
+	}
+}
@@ -0,0 +1,427 @@
+package downloader
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StdinTargets the targets read from stdin, e.g. --targets=-
+const StdinTargets = "-"
+
+// maxIgnoredLines the number of ignored lines listed by the summary of the targets file
+const maxIgnoredLines = 10
+
+// stdin the input of StdinTargets
+var stdin io.Reader = os.Stdin
+
+// targetValue a page ID or a URL read from the targets file, with its line number
+type targetValue struct {
+	line  int
+	value string
+}
+
+// targetsSummary what was made of the lines of the targets file
+type targetsSummary struct {
+	lines      int
+	ignored    []int
+	duplicates int
+	urls       int
+	unresolved int
+}
+
+// String summarizes the targets file in a single message
+func (s *targetsSummary) String() string {
+	var parts []string
+	if s.duplicates > 0 {
+		parts = append(parts, fmt.Sprintf("%d duplicates left out", s.duplicates))
+	}
+	if s.urls > 0 {
+		parts = append(parts, fmt.Sprintf("%d URLs resolved", s.urls-s.unresolved))
+	}
+	if s.unresolved > 0 {
+		parts = append(parts, fmt.Sprintf("%d URLs not found in the crawl", s.unresolved))
+	}
+	if len(s.ignored) > 0 {
+		var lines []string
+		for i, line := range s.ignored {
+			if i == maxIgnoredLines {
+				lines = append(lines, "...")
+				break
+			}
+			lines = append(lines, strconv.Itoa(line))
+		}
+		parts = append(parts, fmt.Sprintf("%d lines ignored (%s)", len(s.ignored), strings.Join(lines, ", ")))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, ", ")
+}
+
+// processTargetFileLine Process file line according our validation rules:
+// If a line:
+// - Contains only digits, the ID is the line.
+// - Starts with digits followed by a comma, the ID is the number up to the comma.
+// - Starts with digits, followed by whitespace, the ID is the number up the the whitespace.
+// - Starts with http:// or https://, the URL up to the whitespace is resolved to the ID of its page.
+// - Does not start with a digit, it is ignored and listed in the summary of the targets file.
+// - Does start with digits followed by anything but whitespace or a comma, it is ignored.
+func processTargetFileLine(line string) (value string, valid bool) {
+
+	// split the line by whitespaces, tabs if any... using string.Fields
+	// this would also respect: if a line contains only digits, the ID is the line
+	// because it's a whole string of digits, well get an array of length 1 and we'll continue processing
+	fields := strings.Fields(line)
+	if len(fields) < 1 {
+		return "", false
+	}
+
+	// remove quoting marks
+	relevantString := strings.Trim(fields[0], "\"")
+	relevantString = strings.Trim(relevantString, "'")
+	if isTargetURL(relevantString) {
+		return relevantString, true
+	}
+
+	// Check the rule: if a line starts with digits followed by a comma, the ID is the number up to the comma.
+	if strings.Contains(relevantString, ",") {
+		relevantString = strings.Split(relevantString, ",")[0]
+	}
+
+	// Check the rules:
+	// - Does not start with a digit ..
+	// - Does start with digits followed by anything but whitespace or a comma
+	// Those can be checked at once. by tring to convert the string to a uint64
+	// since we already got rid of comma, whitespaces, ..etc
+	if _, err := strconv.ParseUint(relevantString, 10, 64); err == nil { // valid line
+		return relevantString, true
+	}
+	return "", false
+}
+
+// isTargetURL tells whether a target is given by the URL of its page
+func isTargetURL(value string) bool {
+	lower := strings.ToLower(value)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// processTargetFile extracts the page IDs from a targets file, either from every line or
+// from a column (TargetsColumn). URLs are resolved to the IDs of their pages, duplicates
+// are left out. What was ignored is logged once, in a summary.
+func (d *Downloader) processTargetFile(filePath string) (ids []uint64, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ids, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return ids, err
+	}
+	// an earlier stage of a pipeline without any row leaves no target to download
+	if d.Pipeline != nil && info.Size() == 0 {
+		d.appendLog(INFO, "Targets: none, the earlier stage found no rows")
+		return ids, nil
+	}
+
+	var values []targetValue
+	var summary targetsSummary
+	if d.TargetsColumn != "" {
+		values, err = readTargetsColumn(file, d.TargetsColumn, &summary)
+	} else {
+		values, err = readTargetsLines(file, &summary)
+	}
+	if err != nil {
+		return ids, err
+	}
+
+	var urls []string
+	for _, value := range values {
+		if isTargetURL(value.value) {
+			urls = append(urls, value.value)
+		}
+	}
+	if err := d.resolveURLs(urls); err != nil {
+		return ids, err
+	}
+
+	seen := make(map[uint64]bool)
+	for _, value := range values {
+		var id uint64
+		if isTargetURL(value.value) {
+			summary.urls++
+			resolved, ok := d.ResolvedURLs[value.value]
+			if !ok {
+				summary.unresolved++
+				continue
+			}
+			id = resolved
+		} else if id, err = strconv.ParseUint(value.value, 10, 64); err != nil {
+			summary.ignored = append(summary.ignored, value.line)
+			continue
+		}
+
+		if seen[id] {
+			summary.duplicates++
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	message := fmt.Sprintf("Targets: %d page IDs out of %d lines", len(ids), summary.lines)
+	if details := summary.String(); details != "" {
+		message += "; " + details
+	}
+	if len(summary.ignored) > 0 || summary.unresolved > 0 {
+		d.appendLog(WARNING, message+"\n")
+	} else {
+		d.appendLog(INFO, message)
+	}
+
+	if len(ids) < 1 && d.Pipeline == nil {
+		return ids, fmt.Errorf("targets file does not contain any valid page ID")
+	}
+	return ids, nil
+}
+
+// readTargetsLines reads a page ID or a URL from every line, see processTargetFileLine
+func readTargetsLines(file io.Reader, summary *targetsSummary) ([]targetValue, error) {
+	var values []targetValue
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		summary.lines++ // line numbers start with 1 NOT 0
+		value, valid := processTargetFileLine(scanner.Text())
+		if !valid {
+			summary.ignored = append(summary.ignored, summary.lines)
+			continue
+		}
+		values = append(values, targetValue{line: summary.lines, value: value})
+	}
+	return values, scanner.Err()
+}
+
+// readTargetsColumn reads the page IDs or URLs of a column of a CSV or TSV file with a
+// header, e.g. a pages export. The column is given by its name or its number, starting
+// with 1. The file is TSV when its header holds a tab.
+func readTargetsColumn(file io.Reader, column string, summary *targetsSummary) ([]targetValue, error) {
+	buffered := bufio.NewReader(file)
+	first, err := buffered.Peek(1)
+	if err != nil || len(first) == 0 {
+		return nil, fmt.Errorf("targets file is empty")
+	}
+	headerLine, _ := buffered.ReadString('\n')
+	reader := csv.NewReader(io.MultiReader(strings.NewReader(headerLine), buffered))
+	if strings.Contains(headerLine, "\t") {
+		reader.Comma = '\t'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("targets file header: %v", err)
+	}
+	summary.lines++
+
+	index := indexOf(header, column)
+	if number, err := strconv.Atoi(column); index < 0 && err == nil && number >= 1 && number <= len(header) {
+		index = number - 1
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("--targets-column: unknown column %q; the available columns are: %s",
+			column, strings.Join(header, ", "))
+	}
+
+	var values []targetValue
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		summary.lines++
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				summary.ignored = append(summary.ignored, summary.lines)
+				continue
+			}
+			return nil, err
+		}
+		value := ""
+		if index < len(record) {
+			value = strings.TrimSpace(record[index])
+		}
+		if value == "" {
+			summary.ignored = append(summary.ignored, summary.lines)
+			continue
+		}
+		values = append(values, targetValue{line: summary.lines, value: value})
+	}
+	return values, nil
+}
+
+// resolveURLs asks the pages API the IDs of the pages of the URLs not resolved yet, a few
+// at once. The IDs are kept in the resume file; the URLs not found in the crawl are not.
+func (d *Downloader) resolveURLs(urls []string) error {
+	if d.ResolvedURLs == nil {
+		d.ResolvedURLs = make(map[string]uint64)
+	}
+	var pending []string
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		if _, ok := d.ResolvedURLs[url]; !ok && !seen[url] {
+			seen[url] = true
+			pending = append(pending, url)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	d.appendLog(INFO, fmt.Sprintf("Resolving %d URLs of the targets file...", len(pending)))
+
+	urlsToResolve := make(chan string)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < PrescanWorkers && i < len(pending); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for url := range urlsToResolve {
+				id, found, err := d.client.ResolvePageID(url)
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("resolving %s: %v", url, err)
+				} else if found {
+					d.ResolvedURLs[url] = id
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, url := range pending {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed || d.Stop {
+			break
+		}
+		urlsToResolve <- url
+	}
+	close(urlsToResolve)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if d.Stop {
+		return ErrStopped
+	}
+	return nil
+}
+
+// ResolvePageID asks the pages API the ID of the page with the given URL, found is false
+// when the crawl has no such page
+func (api *AudistoAPIClient) ResolvePageID(pageURL string) (id uint64, found bool, err error) {
+	client := api.clone()
+	client.Mode, client.Filter, client.Order = "pages", "url:"+pageURL, ""
+	client.Deep, client.Output = false, FormatTSV
+	client.SetChunkSize(1)
+	client.SetNextChunkNumber(0)
+
+	err = retry(5, 3, func() error {
+		body, statusCode, err := client.FetchChunk(false)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		if statusCode != 200 {
+			if message, ok := StatusCodesErrors[statusCode]; ok {
+				return errors.New(message)
+			}
+			return fmt.Errorf("Unknown error occurred (code %v)", statusCode)
+		}
+		id, found, err = readPageID(body, pageURL)
+		return err
+	}, nil)
+	return id, found, err
+}
+
+// readPageID reads the ID of the page with the given URL from a TSV chunk, found is false
+// when the chunk has no such page, e.g. when the filter matched other pages only
+func readPageID(body io.Reader, pageURL string) (id uint64, found bool, err error) {
+	reader := bufio.NewReader(body)
+	header, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	columns := strings.Split(strings.TrimRight(header, "\r\n"), "\t")
+	idColumn, urlColumn := indexOf(columns, "id"), indexOf(columns, "url")
+	if idColumn < 0 || urlColumn < 0 {
+		return 0, false, fmt.Errorf("the pages have no id or url column")
+	}
+
+	for {
+		row, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		fields := strings.Split(strings.TrimRight(row, "\r\n"), "\t")
+		if row != "" && idColumn < len(fields) && urlColumn < len(fields) && fields[urlColumn] == pageURL {
+			id, err = strconv.ParseUint(fields[idColumn], 10, 64)
+			return id, err == nil, err
+		}
+		if err == io.EOF {
+			return 0, false, nil
+		}
+	}
+}
+
+// spoolTargets copies the targets read from stdin to a file, next to the resume file when
+// there is one, so they can be read again and checked when resuming
+func (d *Downloader) spoolTargets() (err error) {
+	var file *os.File
+	if d.canResume() {
+		file, err = os.Create(strings.TrimSuffix(d.getResumeFilename(), "_") + ".targets")
+	} else {
+		file, err = ioutil.TempFile("", "audisto-targets")
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	if _, err = io.Copy(file, stdin); err != nil {
+		return fmt.Errorf("reading the targets from stdin: %v", err)
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	d.currentTargetsFilename = file.Name()
+	d.targetsSpool = file.Name()
+	return nil
+}
+
+// removeSpool removes the copy of the targets read from stdin
+func (d *Downloader) removeSpool() {
+	if d.targetsSpool != "" {
+		os.Remove(d.targetsSpool)
+		d.targetsSpool = ""
+	}
+}
@@ -0,0 +1,166 @@
+package downloader
+
+import (
+	"sync"
+	"time"
+)
+
+// throughput estimates the rows and bytes per second of a download with exponentially
+// weighted moving averages, updated with every chunk. The time between two chunks counts,
+// so the waits for retries, throttling and the rate limits slow the estimate down.
+type throughput struct {
+	mu      sync.Mutex
+	started time.Time
+	last    time.Time
+	// rows and bytes per second, latency the seconds a request takes
+	rows, bytes, latency float64
+	samples              int
+}
+
+// start restarts the clock, the averages of a previous run are kept
+func (t *throughput) start(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started, t.last = now, now
+}
+
+// observe adds a chunk received at now to the averages
+func (t *throughput) observe(rows uint64, bytes int64, latency time.Duration, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last.IsZero() {
+		t.started, t.last = now, now
+		return
+	}
+	elapsed := now.Sub(t.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	t.last = now
+
+	rowRate, byteRate := float64(rows)/elapsed, float64(bytes)/elapsed
+	if t.samples == 0 {
+		t.rows, t.bytes, t.latency = rowRate, byteRate, latency.Seconds()
+	} else {
+		t.rows = ewma(t.rows, rowRate)
+		t.bytes = ewma(t.bytes, byteRate)
+		t.latency = ewma(t.latency, latency.Seconds())
+	}
+	t.samples++
+}
+
+// rates returns the averages, all 0 before the first chunk
+func (t *throughput) rates() (rows, bytes, latency float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rows, t.bytes, t.latency
+}
+
+// elapsed returns the time since the download started
+func (t *throughput) elapsed(now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.started.IsZero() {
+		return 0
+	}
+	return now.Sub(t.started)
+}
+
+// ewma weighs a new sample into an average
+func ewma(average, sample float64) float64 {
+	return SMOOTHINGFACTOR*sample + (1-SMOOTHINGFACTOR)*average
+}
+
+// remainingWork returns the rows left to download across the targets and the stages,
+// and the number of targets not started yet. Unless the targets were pre-scanned, the
+// rows of the targets not started yet are estimated from the ones done.
+func (d *Downloader) remainingWork() (rows uint64, targets uint64) {
+	if !d.isInTargetsMode() || d.currentTargetsFilename == "self" {
+		total, done := d.sampledRows(d.CurrentTarget.TotalElements, d.CurrentTarget.DoneElements)
+		if done < total {
+			rows = total - done
+		}
+		// the pages of --targets=self are the targets of the links stage, their links are unknown
+		if d.isInTargetsMode() {
+			return rows, d.TotalElements
+		}
+		return rows, 0
+	}
+
+	progress := d.targetsProgress()
+	var running uint64
+	for _, target := range progress.running {
+		if target.DoneElements < target.TotalElements {
+			rows += target.TotalElements - target.DoneElements
+		}
+		running += target.DoneElements
+	}
+	targets = uint64(len(progress.pending))
+	if targets == 0 {
+		return rows, 0
+	}
+
+	if d.prescanned {
+		for _, index := range progress.pending {
+			rows += d.TargetElements[d.ids[index]]
+		}
+		return rows, targets
+	}
+
+	average := progress.current().TotalElements
+	if progress.finished > 0 && progress.done >= running {
+		average = (progress.done - running) / uint64(progress.finished)
+	}
+	return rows + targets*average, targets
+}
+
+// estimate returns the overall ETA and the one of the current target, 0 until the
+// throughput is known
+func (d *Downloader) estimate() (overall, target time.Duration) {
+	rowRate, _, latency := d.speed.rates()
+	if rowRate <= 0 {
+		return 0, 0
+	}
+
+	var current currentTarget
+	workers := 1
+	if d.isInTargetsMode() && d.currentTargetsFilename != "self" {
+		progress := d.targetsProgress()
+		current = progress.current()
+		if len(progress.running) > 1 {
+			workers = len(progress.running)
+		}
+	} else {
+		current = d.CurrentTarget
+	}
+	total, done := d.sampledRows(current.TotalElements, current.DoneElements)
+	if done < total {
+		target = seconds(float64(total-done) / rowRate)
+	}
+
+	rows, targets := d.remainingWork()
+	// every target asks for its total elements unless pre-scanned, and for at least
+	// one chunk when its rows are unknown. The workers ask for several targets at once.
+	var perTarget float64
+	if !d.prescanned {
+		perTarget = latency
+	}
+	if d.currentTargetsFilename == "self" && !d.PagesSelfTargetsCompleted {
+		perTarget += latency
+	}
+	overall = seconds(float64(rows)/rowRate + float64(targets)*perTarget/float64(workers))
+
+	// the download can't be faster than the rate limits allow
+	if limited := d.limitedETA(rows); limited > overall {
+		overall = limited
+	}
+	if target > overall {
+		overall = target
+	}
+	return overall, target
+}
+
+// seconds converts seconds to a duration, rounded to the second
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Second)
+}
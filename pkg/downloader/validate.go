@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// maxChunkRetries the number of times a chunk failing validation is requested again
+// before it is skipped (or the download fails in strict mode)
+const maxChunkRetries = 3
+
+// AnomalyKind the kind of inconsistency found while validating the downloaded chunks
+type AnomalyKind string
+
+const (
+	// AnomalyHeader a chunk came with a header different than the first chunk
+	AnomalyHeader AnomalyKind = "header"
+	// AnomalyColumns a row has more or less columns than the header
+	AnomalyColumns AnomalyKind = "columns"
+	// AnomalyRowCount a chunk (other than the last one) has less rows than requested
+	AnomalyRowCount AnomalyKind = "rows"
+	// AnomalyType a row has a value that doesn't convert to the type of its field, see
+	// OnBatch, or a page ID that isn't a number
+	AnomalyType AnomalyKind = "type"
+)
+
+// errHeaderMismatch is returned by processChunk when a chunk header differs from the first one
+var errHeaderMismatch = errors.New("header differs from the one of the first chunk")
+
+// Anomaly an inconsistency found in the downloaded data and accepted (skipped) by the downloader
+type Anomaly struct {
+	Kind AnomalyKind `json:"kind"`
+	// TargetPageID is only set in targets mode
+	TargetPageID uint64 `json:"targetPageID,omitempty"`
+	Chunk        uint64 `json:"chunk"`
+	Message      string `json:"message"`
+}
+
+// IntegrityError is returned in strict mode when the downloaded data fails validation
+type IntegrityError struct {
+	Anomaly Anomaly
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("Integrity check failed, %s", e.Anomaly)
+}
+
+func (a Anomaly) String() string {
+	if a.TargetPageID > 0 {
+		return fmt.Sprintf("target %d, chunk %d: %s", a.TargetPageID, a.Chunk, a.Message)
+	}
+	return fmt.Sprintf("chunk %d: %s", a.Chunk, a.Message)
+}
+
+// countColumns returns the number of tab separated columns of a row
+func countColumns(row []byte) int {
+	return bytes.Count(row, []byte("\t")) + 1
+}
+
+// checkHeader makes sure every chunk comes with the same header. The header of the
+// very first chunk is remembered and written to the output.
+func (d *Downloader) checkHeader(header []byte) error {
+	if d.Header == "" {
+		d.Header = string(header)
+		if err := d.prepareRows(); err != nil {
+			return err
+		}
+		if d.DoneElements == 0 {
+			if err := d.out.writeHeader([]byte(d.outputHeader())); err != nil {
+				return &writeError{err}
+			}
+		}
+		return nil
+	}
+
+	if d.headerColumns == 0 {
+		// resumed download, the header comes from the resume file
+		if err := d.prepareRows(); err != nil {
+			return err
+		}
+	}
+
+	if string(header) != d.Header {
+		return errHeaderMismatch
+	}
+	return nil
+}
+
+// recordAnomaly fails with the anomaly in strict mode, otherwise the anomaly is
+// kept for the final summary and the download carries on.
+func (d *Downloader) recordAnomaly(kind AnomalyKind, message string) error {
+	anomaly := d.newAnomaly(kind, message)
+
+	if d.Strict {
+		return &IntegrityError{Anomaly: anomaly}
+	}
+
+	d.Anomalies = append(d.Anomalies, anomaly)
+	d.appendLog(WARNING, fmt.Sprintf("Skipped: %s\n", anomaly))
+	return nil
+}
+
+// newAnomaly describes an anomaly found in the chunk currently being downloaded
+func (d *Downloader) newAnomaly(kind AnomalyKind, message string) Anomaly {
+	anomaly := Anomaly{
+		Kind:    kind,
+		Chunk:   d.client.ChunkNumber,
+		Message: message,
+	}
+	if d.isInTargetsMode() && d.currentTargetsFilename != "self" && d.TargetsFileNextID < len(d.ids) {
+		anomaly.TargetPageID = d.ids[d.TargetsFileNextID]
+	}
+	return anomaly
+}
+
+// expectedRows returns the number of rows a complete chunk starting at chunkStart
+// has after skipping `skip` rows, and whether it is the last chunk of the target.
+func (d *Downloader) expectedRows(chunkStart, skip uint64) (expected uint64, last bool) {
+	end := chunkStart + d.client.ChunkSize
+	if end >= d.CurrentTarget.TotalElements {
+		end = d.CurrentTarget.TotalElements
+		last = true
+	}
+	if end > chunkStart+skip {
+		expected = end - chunkStart - skip
+	}
+	return expected, last
+}
+
+// rejectChunk handles a chunk that failed validation: it is requested again while
+// retries are left, then the download either fails (strict mode) or skips over
+// the rest of the chunk.
+func (d *Downloader) rejectChunk(retries *int, chunkStart uint64, kind AnomalyKind, message string) error {
+	*retries++
+	if *retries <= maxChunkRetries {
+		atomic.AddInt64(&errorCount, 1)
+		d.appendLog(WARNING, fmt.Sprintf("Chunk %d: %s; requesting it again\n", d.client.ChunkNumber, message))
+		return nil
+	}
+	*retries = 0
+
+	if err := d.recordAnomaly(kind, message); err != nil {
+		return err
+	}
+
+	end := chunkStart + d.client.ChunkSize
+	if end > d.CurrentTarget.TotalElements {
+		end = d.CurrentTarget.TotalElements
+	}
+	if end > d.CurrentTarget.DoneElements {
+		missing := end - d.CurrentTarget.DoneElements
+		d.CurrentTarget.DoneElements += missing
+		d.DoneElements += missing
+		// we don't have the rows preceding the next chunk, its boundary can't be checked
+		d.CurrentTarget.LastRow = ""
+	}
+	return nil
+}
+
+// AnomaliesSummary returns a human readable summary of the anomalies found, by kind
+func (d *Downloader) AnomaliesSummary() string {
+	return SummarizeAnomalies(d.Anomalies)
+}
+
+// SummarizeAnomalies returns a human readable summary of the given anomalies, by kind
+func SummarizeAnomalies(anomalies []Anomaly) string {
+	if len(anomalies) == 0 {
+		return ""
+	}
+
+	counts := make(map[AnomalyKind]int)
+	for _, anomaly := range anomalies {
+		counts[anomaly.Kind]++
+	}
+
+	var kinds []string
+	for kind, count := range counts {
+		kinds = append(kinds, fmt.Sprintf("%d %s", count, kind))
+	}
+	sort.Strings(kinds)
+
+	return fmt.Sprintf("%d anomalies were skipped (%s)", len(anomalies), strings.Join(kinds, ", "))
+}
@@ -0,0 +1,342 @@
+package downloader
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression a condition on the columns of a row, such as
+// `status_code >= 400 && url ~ "/blog/"`. It supports the comparison operators
+// ==, !=, <, <=, > and >= (numeric when both sides are numbers), the regular
+// expression operators ~ and !~, &&, ||, ! and parentheses.
+type Expression struct {
+	source string
+	root   exprNode
+	// columns the identifiers used in the expression, bound to their index in the header
+	columns map[string]*columnOperand
+}
+
+// ParseExpression parses a row condition
+func ParseExpression(source string) (*Expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+
+	p := &exprParser{tokens: tokens, columns: make(map[string]*columnOperand)}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+	}
+	return &Expression{source: source, root: root, columns: p.columns}, nil
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// bind resolves the columns used in the expression against the header columns
+func (e *Expression) bind(header []string) error {
+	for name, column := range e.columns {
+		column.index = indexOf(header, name)
+		if column.index < 0 {
+			return fmt.Errorf("unknown column %q in %q", name, e.source)
+		}
+	}
+	return nil
+}
+
+// Match evaluates the expression against the fields of a row
+func (e *Expression) Match(fields []string) bool {
+	return e.root.eval(fields)
+}
+
+type exprNode interface {
+	eval(fields []string) bool
+}
+
+type orNode struct{ left, right exprNode }
+
+func (n *orNode) eval(fields []string) bool { return n.left.eval(fields) || n.right.eval(fields) }
+
+type andNode struct{ left, right exprNode }
+
+func (n *andNode) eval(fields []string) bool { return n.left.eval(fields) && n.right.eval(fields) }
+
+type notNode struct{ node exprNode }
+
+func (n *notNode) eval(fields []string) bool { return !n.node.eval(fields) }
+
+// truthNode a single operand used as a condition, true unless empty, 0 or false
+type truthNode struct{ operand operand }
+
+func (n *truthNode) eval(fields []string) bool {
+	value := n.operand.value(fields)
+	return value != "" && value != "0" && !strings.EqualFold(value, "false")
+}
+
+type compareNode struct {
+	op          string
+	left, right operand
+}
+
+func (n *compareNode) eval(fields []string) bool {
+	left, right := n.left.value(fields), n.right.value(fields)
+
+	var cmp int
+	l, lErr := strconv.ParseFloat(left, 64)
+	r, rErr := strconv.ParseFloat(right, 64)
+	switch {
+	case lErr == nil && rErr == nil:
+		if l < r {
+			cmp = -1
+		} else if l > r {
+			cmp = 1
+		}
+	default:
+		cmp = strings.Compare(left, right)
+	}
+
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+type matchNode struct {
+	operand operand
+	re      *regexp.Regexp
+	negate  bool
+}
+
+func (n *matchNode) eval(fields []string) bool {
+	return n.re.MatchString(n.operand.value(fields)) != n.negate
+}
+
+type operand interface {
+	value(fields []string) string
+}
+
+type literalOperand string
+
+func (o literalOperand) value(fields []string) string { return string(o) }
+
+type columnOperand struct {
+	name  string
+	index int
+}
+
+func (o *columnOperand) value(fields []string) string {
+	if o.index < 0 || o.index >= len(fields) {
+		return ""
+	}
+	return fields[o.index]
+}
+
+type tokenKind int
+
+const (
+	tokenIdentifier tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "!~", "<", ">", "~", "!", "(", ")"}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			// a quoted string, backslash escapes the quote
+			var value strings.Builder
+			j := i + 1
+			for ; j < len(source) && rune(source[j]) != c; j++ {
+				if source[j] == '\\' && j+1 < len(source) && rune(source[j+1]) == c {
+					j++
+				}
+				value.WriteByte(source[j])
+			}
+			if j == len(source) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, token{tokenString, value.String()})
+			i = j + 1
+		case unicode.IsDigit(c) || c == '-' || c == '.':
+			j := i + 1
+			for j < len(source) && (unicode.IsDigit(rune(source[j])) || source[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, source[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(source) && (unicode.IsLetter(rune(source[j])) || unicode.IsDigit(rune(source[j])) ||
+				source[j] == '_' || source[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokenIdentifier, source[i:j]})
+			i = j
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, token{tokenOperator, op})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q", c)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// exprParser a recursive descent parser, from the lowest precedence (||) to the highest
+type exprParser struct {
+	tokens  []token
+	pos     int
+	columns map[string]*columnOperand
+}
+
+func (p *exprParser) peek(op string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOperator && p.tokens[p.pos].text == op
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek("||") {
+		p.pos++
+		var right exprNode
+		if right, err = p.parseAnd(); err == nil {
+			left = &orNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.peek("&&") {
+		p.pos++
+		var right exprNode
+		if right, err = p.parseUnary(); err == nil {
+			left = &andNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek("!") {
+		p.pos++
+		node, err := p.parseUnary()
+		return &notNode{node}, err
+	}
+	if p.peek("(") {
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return node, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.peek(op) {
+			p.pos++
+			right, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return &compareNode{op, left, right}, nil
+		}
+	}
+
+	for _, op := range []string{"~", "!~"} {
+		if p.peek(op) {
+			p.pos++
+			if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenString {
+				return nil, fmt.Errorf("%s expects a quoted regular expression", op)
+			}
+			re, err := regexp.Compile(p.tokens[p.pos].text)
+			if err != nil {
+				return nil, err
+			}
+			p.pos++
+			return &matchNode{left, re, op == "!~"}, nil
+		}
+	}
+
+	return &truthNode{left}, nil
+}
+
+func (p *exprParser) parseOperand() (operand, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch t.kind {
+	case tokenString, tokenNumber:
+		return literalOperand(t.text), nil
+	case tokenIdentifier:
+		column, ok := p.columns[t.text]
+		if !ok {
+			column = &columnOperand{name: t.text, index: -1}
+			p.columns[t.text] = column
+		}
+		return column, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
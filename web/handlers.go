@@ -2,11 +2,10 @@ package web
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/audisto/data-downloader/pkg/downloader"
 	"github.com/gin-gonic/gin"
@@ -37,6 +36,7 @@ func (wd *WebDownloader) doLogin(c *gin.Context) {
 	loginJSON, _ := json.Marshal(loginPayload)
 	err = createConfigFile(loginJSON)
 	if err != nil {
+		wd.Logger.Error("could not save the credentials", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -78,30 +78,31 @@ func (wd *WebDownloader) downloadHandler(c *gin.Context) {
 		username, password = getPersistedCredentials()
 	}
 
+	options, err := downloadOptions.options(wd.Hooks)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	options.Username, options.Password = username, password
+
 	progressReport = make(chan downloader.StatusReport)
 	down = downloader.New(progressReport)
-
-	err = down.Setup(username, password, downloadOptions.CrawlID, downloadOptions.Mode,
-		!downloadOptions.Details, 0, 0, downloadOptions.Output, downloadOptions.Filter,
-		!downloadOptions.Resume, downloadOptions.Order, "")
+	down.Logger = wd.Logger
+	down.Subscribe(&broadcaster{wd: wd})
+	err = down.SetupOptions(options)
 
 	if err != nil {
+		wd.Logger.Warn("download rejected", "crawl", options.Crawl, "error", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	down.Subscribe(wd.metrics.job())
 
 	go func() {
+		// the downloader logs how it ended
 		err = down.Start()
-		log.Println(err)
 		if err != nil {
-			message := &ProgressMessage{Error: err.Error()}
-
-			asJSON, err := json.Marshal(message)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			wd.WebSocket.Broadcast(asJSON)
+			// the broadcaster told the page about the error
 			return
 		}
 		wd.downloaderCount++
@@ -116,16 +117,26 @@ func (wd *WebDownloader) downloadHandler(c *gin.Context) {
 				}
 				percentage := strconv.FormatFloat(progress.ProgressPercentage, 'f', 2, 64)
 				message := &ProgressMessage{
-					ProgressPercentage: percentage,
-					ETA:                progress.ETA.String(),
-					TotalElements:      progress.TotalElements,
-					DoneElements:       progress.DoneElements,
-					ChunkSize:          progress.ChunkSize,
-					ErrorsCount:        progress.ErrorsCount,
+					ProgressPercentage:   percentage,
+					ETA:                  progress.ETA.String(),
+					TargetETA:            progress.TargetETA.String(),
+					Elapsed:              progress.Elapsed.String(),
+					RowsPerSecond:        strconv.FormatFloat(progress.RowsPerSecond, 'f', 0, 64),
+					BytesPerSecond:       int64(progress.BytesPerSecond),
+					TotalElements:        progress.TotalElements,
+					DoneElements:         progress.DoneElements,
+					ChunkSize:            progress.ChunkSize,
+					ErrorsCount:          progress.ErrorsCount,
+					IsIngTargetMode:      progress.IsIngTargetMode,
+					TotalIDsCount:        progress.TotalIDsCount,
+					CurrentIDOrderNumber: progress.CurrentIDOrderNumber,
+					AnomaliesCount:       len(progress.Anomalies),
+					MaxRate:              progress.MaxRate,
+					MaxRequestsPerMinute: progress.MaxRequestsPerMinute,
 				}
 				asJSON, err := json.Marshal(message)
 				if err != nil {
-					fmt.Println(err)
+					wd.Logger.Error("could not encode the progress", "error", err)
 					return
 				}
 				wd.WebSocket.Broadcast(asJSON)
@@ -136,6 +147,32 @@ func (wd *WebDownloader) downloadHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Download started"})
 }
 
+// broadcaster observes the download, its log messages and errors are sent over the
+// websocket as they happen, in between the progress reports
+type broadcaster struct {
+	downloader.NopObserver
+	wd *WebDownloader
+}
+
+// OnLog sends the message
+func (b *broadcaster) OnLog(level downloader.LogType, message string) {
+	b.broadcast(&ProgressMessage{LogMessage: strings.TrimSpace(string(level) + ": " + message)})
+}
+
+// OnError sends the error the download stopped on
+func (b *broadcaster) OnError(err error) {
+	b.broadcast(&ProgressMessage{Error: err.Error()})
+}
+
+func (b *broadcaster) broadcast(message *ProgressMessage) {
+	asJSON, err := json.Marshal(message)
+	if err != nil {
+		b.wd.Logger.Error("could not encode the message", "error", err)
+		return
+	}
+	b.wd.WebSocket.Broadcast(asJSON)
+}
+
 func (wd *WebDownloader) stopHandler(c *gin.Context) {
 	if down != nil {
 		down.Stop = true
@@ -147,6 +184,29 @@ func (wd *WebDownloader) stopHandler(c *gin.Context) {
 	}
 }
 
+// limitsHandler changes the rate limits of the running download
+func (wd *WebDownloader) limitsHandler(c *gin.Context) {
+	var limits Limits
+	if err := c.BindJSON(&limits); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rate, requests, err := limits.parse()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if down == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "No download in progress"})
+		return
+	}
+	if err = down.SetLimits(rate, requests); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Limits updated"})
+}
+
 func (wd *WebDownloader) progressHandler(c *gin.Context) {
 	wd.WebSocket.HandleRequest(c.Writer, c.Request)
 }
@@ -0,0 +1,181 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/audisto/data-downloader/pkg/downloader"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace the prefix of the metrics exposed on /metrics
+const metricsNamespace = "data_downloader"
+
+// States and outcomes of the download jobs
+const (
+	jobQueued    = "queued"
+	jobActive    = "active"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+	jobStopped   = "stopped"
+)
+
+// metrics the Prometheus metrics of the downloads run by the web interface, fed by
+// observing the downloads
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests   *prometheus.CounterVec
+	latency    prometheus.Histogram
+	chunkBytes prometheus.Histogram
+	bytes      prometheus.Counter
+	rows       prometheus.Counter
+	retries    prometheus.Counter
+	throttles  prometheus.Counter
+	chunkSize  prometheus.Gauge
+	jobs       *prometheus.GaugeVec
+	outcomes   *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_requests_total",
+			Help:      "Chunk requests made to Audisto API, by status code.",
+		}, []string{"status"}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "chunk_latency_seconds",
+			Help:      "Time from the request of a chunk until it was read.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+		}),
+		chunkBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "chunk_bytes",
+			Help:      "Size of the chunks received.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+		}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "downloaded_bytes_total",
+			Help:      "Bytes received from Audisto API.",
+		}),
+		rows: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "downloaded_rows_total",
+			Help:      "Rows received from Audisto API.",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "retries_total",
+			Help:      "Failed requests made again.",
+		}),
+		throttles: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "throttles_total",
+			Help:      "Times the chunk size was lowered after server timeouts.",
+		}),
+		chunkSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "chunk_size",
+			Help:      "Chunk size of the current download.",
+		}),
+		jobs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "jobs",
+			Help:      "Downloads accepted but not started yet (queued) and running (active).",
+		}, []string{"state"}),
+		outcomes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "jobs_finished_total",
+			Help:      "Downloads that ended, by outcome: completed, failed or stopped.",
+		}, []string{"outcome"}),
+	}
+	m.registry.MustRegister(m.requests, m.latency, m.chunkBytes, m.bytes, m.rows, m.retries,
+		m.throttles, m.chunkSize, m.jobs, m.outcomes)
+
+	// expose the series before the first download
+	for _, state := range []string{jobQueued, jobActive} {
+		m.jobs.WithLabelValues(state)
+	}
+	for _, outcome := range []string{jobCompleted, jobFailed, jobStopped} {
+		m.outcomes.WithLabelValues(outcome)
+	}
+	return m
+}
+
+// handler serves the metrics in the Prometheus text format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// job returns the observer feeding the metrics with a download, queued until it starts
+func (m *metrics) job() *jobMetrics {
+	m.jobs.WithLabelValues(jobQueued).Inc()
+	return &jobMetrics{m: m}
+}
+
+// jobMetrics observes a download for the metrics
+type jobMetrics struct {
+	downloader.NopObserver
+	m       *metrics
+	started bool
+}
+
+// OnStart moves the job from the queued to the active ones
+func (j *jobMetrics) OnStart(event downloader.StartEvent) {
+	j.started = true
+	j.m.jobs.WithLabelValues(jobQueued).Dec()
+	j.m.jobs.WithLabelValues(jobActive).Inc()
+}
+
+// OnChunkFetched counts the request, and what it received
+func (j *jobMetrics) OnChunkFetched(event downloader.ChunkEvent) {
+	j.m.requests.WithLabelValues(strconv.Itoa(event.StatusCode)).Inc()
+	j.m.latency.Observe(event.Latency.Seconds())
+	j.m.chunkSize.Set(float64(event.ChunkSize))
+	if event.StatusCode == http.StatusOK {
+		j.m.chunkBytes.Observe(float64(event.Bytes))
+	}
+	j.m.bytes.Add(float64(event.Bytes))
+	j.m.rows.Add(float64(event.Rows))
+}
+
+// OnRetry counts the retry
+func (j *jobMetrics) OnRetry(event downloader.RetryEvent) {
+	j.m.retries.Inc()
+}
+
+// OnThrottle counts the throttling, and the new chunk size
+func (j *jobMetrics) OnThrottle(chunkSize uint64) {
+	j.m.throttles.Inc()
+	j.m.chunkSize.Set(float64(chunkSize))
+}
+
+// OnComplete counts the completed job
+func (j *jobMetrics) OnComplete(report downloader.StatusReport) {
+	j.finish(jobCompleted)
+}
+
+// OnError counts the failed or stopped job
+func (j *jobMetrics) OnError(err error) {
+	if err == downloader.ErrStopped {
+		j.finish(jobStopped)
+	} else {
+		j.finish(jobFailed)
+	}
+}
+
+func (j *jobMetrics) finish(outcome string) {
+	if j.started {
+		j.m.jobs.WithLabelValues(jobActive).Dec()
+	} else {
+		j.m.jobs.WithLabelValues(jobQueued).Dec()
+	}
+	j.started = false
+	j.m.outcomes.WithLabelValues(outcome).Inc()
+	j.m.chunkSize.Set(0)
+}
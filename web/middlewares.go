@@ -8,6 +8,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/audisto/data-downloader/pkg/downloader"
 	"github.com/gin-gonic/gin"
 	"github.com/mattn/go-isatty"
 )
@@ -94,6 +95,25 @@ func LoggerWithWriter(out io.Writer, notlogged ...string) gin.HandlerFunc {
 	}
 }
 
+// StructuredLogger logs every request to logger, at the DEBUG level unless it failed
+func StructuredLogger(logger *downloader.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		if logger == nil {
+			return
+		}
+		level := downloader.DEBUG
+		if c.Writer.Status() >= 500 {
+			level = downloader.WARNING
+		}
+		// the query is left out, it is not needed to follow the requests
+		logger.Log(level, "request", "method", c.Request.Method, "path", c.Request.URL.Path,
+			"status", c.Writer.Status(), "latency", time.Since(start), "ip", c.ClientIP())
+	}
+}
+
 func colorForStatus(code int) string {
 	switch {
 	case code >= 200 && code < 300:
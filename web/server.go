@@ -13,6 +13,7 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/audisto/data-downloader/pkg/downloader"
 	_ "github.com/audisto/data-downloader/web/statik" // compiled static files
 	"github.com/gin-gonic/gin"
 	"github.com/rakyll/statik/fs"
@@ -36,8 +37,9 @@ func init() {
 	}
 }
 
-// StartWebInterface -
-func StartWebInterface(port uint, debug bool) {
+// StartWebInterface - the requests, downloads and errors are written to logger, if any;
+// the hooks, if any, are notified of every download
+func StartWebInterface(port uint, debug bool, logger *downloader.Logger, hooks *downloader.Hooks) {
 
 	if !debug {
 		gin.SetMode(gin.ReleaseMode)
@@ -45,8 +47,11 @@ func StartWebInterface(port uint, debug bool) {
 
 	server := gin.New()
 	webDownloader := NewWebDownloader()
+	webDownloader.Logger = logger.With("component", "web")
+	webDownloader.Hooks = hooks
 	server.SetHTMLTemplate(getTemplates())
 	server.Use(Logger())
+	server.Use(StructuredLogger(webDownloader.Logger))
 	server.Use(gin.Recovery())
 	server.StaticFS("/static", EmbeddedFS)
 	server.GET("/", webDownloader.homeHandler)
@@ -54,11 +59,16 @@ func StartWebInterface(port uint, debug bool) {
 	server.GET("/logout", webDownloader.doLogout)
 	server.POST("/download", webDownloader.downloadHandler)
 	server.POST("/stop", webDownloader.stopHandler)
+	server.POST("/limits", webDownloader.limitsHandler)
 	server.GET("/progress", webDownloader.progressHandler)
+	server.GET("/metrics", gin.WrapH(webDownloader.metrics.handler()))
 
 	fmt.Printf(banner, port)
 	addr := fmt.Sprintf("0.0.0.0:%d", port)
-	server.Run(addr)
+	webDownloader.Logger.Info("web interface started", "addr", addr)
+	if err := server.Run(addr); err != nil {
+		webDownloader.Logger.Error("web interface stopped", "error", err)
+	}
 }
 
 func getTemplates() *template.Template {
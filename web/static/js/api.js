@@ -24,6 +24,32 @@ var apiDownload = function(downloadOptions){
   });
 }
 
+var apiSetLimits = function(limits) {
+  $.ajax({
+    url: '/limits',
+    type: 'POST',
+    data: JSON.stringify(limits),
+    cache: false,
+    dataType: 'json',
+    processData: false,
+    contentType: false,
+    success: function(data, textStatus, jqXHR)
+    {
+      $("#notifications").removeClass('is-danger').addClass('is-success');
+      $("#notifications").html(data.message)
+      $("#notifications").fadeIn("slow");
+      $("#notifications").fadeOut("slow");
+    },
+    error: function(jqXHR, textStatus, errorThrown)
+    {
+      $("#notifications").removeClass('is-success').addClass('is-danger');
+      $("#notifications").html(jqXHR.responseJSON.error)
+      $("#notifications").fadeIn("slow")
+      $("#notifications").fadeOut("slow")
+    }
+  });
+}
+
 var apiStopDownload = function() {
   $.ajax({
     url: '/stop',
@@ -69,6 +69,10 @@ $( document ).ready(function() {
     apiStopDownload()
   })
 
+  $("#apply-limits-button").on('click', function() {
+    apiSetLimits(gatherLimits())
+  })
+
 
 });
 
@@ -81,33 +85,78 @@ var gatherOptions = function() {
     'mode': mode,
     'filter': $("#filter-input").val().trim(),
     'order': $("#order-input").val().trim(),
+    'columns': $("#columns-input").val().trim(),
+    'where': $("#where-input").val().trim(),
     'resume': !$("#do-not-resume-checkbox").is(':checked'),
     'details': !$("#hide-details-checkbox").is(':checked'),
     'target': targetFileData,
     "output": $("#output-filepath-input").val().trim(),
+    'maxRate': $("#max-rate-input").val().trim(),
+    'maxRequestsPerMinute': $("#max-requests-input").val().trim(),
     // credential override:
     'username': $("#custom-username-input").val().trim(),
     'password': $("#custom-password-input").val().trim()
   }
 }
 
+var gatherLimits = function() {
+  return {
+    'maxRate': $("#max-rate-input").val().trim(),
+    'maxRequestsPerMinute': $("#max-requests-input").val().trim()
+  }
+}
+
 
 var initPageElements = function() {
   $("#mode-select").trigger("change");
 }
 
+// prettyBytes formats a size the way the command line does, e.g. 1.5M
+var prettyBytes = function(bytes) {
+  var units = ["B", "K", "M", "G", "T"]
+  var i = 0
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024
+    i++
+  }
+  return (i == 0 ? bytes : bytes.toFixed(1)) + units[i]
+}
+
 var webSocketURL = "ws://" + window.location.host + "/progress";
 
 function start(webSocketURL){
   ws = new WebSocket(webSocketURL);
   ws.onmessage = function(evt) {
     message = JSON.parse(evt.data)
+    // log messages and errors come on their own, in between the progress reports
+    if (message.error || message.logMessage) {
+      $("#notifications").toggleClass('is-danger', !!message.error).toggleClass('is-success', !message.error);
+      $("#notifications").text(message.error || message.logMessage)
+      $("#notifications").fadeIn("slow");
+      return
+    }
     $("progress").attr('value', message.progressPercentage)
     $("#ETA").html("ETA: " + message.ETA)
+    if (message.isTargetMode) {
+      $("#ETA").append(" (target: " + message.targetETA + ")")
+    }
+    $("#throughput").html("Throughput: " + message.rowsPerSecond + " rows/s, " + prettyBytes(message.bytesPerSecond) + "/s")
+    $("#elapsed").html("Elapsed: " + message.elapsed)
     $("#totalElements").html("Total Elements: " + message.totalElements)
     $("#chunkSize").html("Chunk Size: " + message.chunkSize)
     $("#doneElements").html("Done Elements: " + message.doneElements)
     $("#errors").html("Errors: " + message.errorsCount)
+    if (message.anomaliesCount > 0) {
+      $("#errors").append(" (" + message.anomaliesCount + " skipped)")
+    }
+    var limits = []
+    if (message.maxRate > 0) {
+      limits.push(prettyBytes(message.maxRate) + "/s")
+    }
+    if (message.maxRequestsPerMinute > 0) {
+      limits.push(message.maxRequestsPerMinute + " requests/min")
+    }
+    $("#limits").html("Limits: " + (limits.length ? limits.join(", ") : "none"))
 
   };
   ws.onclose = function(){
@@ -1,6 +1,10 @@
 package web
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/audisto/data-downloader/pkg/downloader"
 	"gopkg.in/olahol/melody.v1"
 )
@@ -21,16 +25,82 @@ type JsonPayload struct {
 	Mode     string `json:"mode"`
 	Filter   string `json:"filter"`
 	Order    string `json:"order"`
+	Columns  string `json:"columns"`
+	Where    string `json:"where"`
 	Resume   bool   `json:"resume"`
 	Details  bool   `json:"details"`
 	Target   string `json:"target"`
 	Output   string `json:"output"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Limits
+}
+
+// Limits the rate limits of a download, as typed in the form. Empty means no limit.
+type Limits struct {
+	// MaxRate a size per second, e.g. 500KB
+	MaxRate              string `json:"maxRate"`
+	MaxRequestsPerMinute string `json:"maxRequestsPerMinute"`
+}
+
+// parse returns the bytes per second and the requests per minute, 0 meaning no limit
+func (l Limits) parse() (int64, int, error) {
+	var rate int64
+	var requests int
+	var err error
+	if value := strings.TrimSpace(l.MaxRate); value != "" {
+		if rate, err = downloader.ParseByteSize(value); err != nil {
+			return 0, 0, fmt.Errorf("max rate: %v", err)
+		}
+	}
+	if value := strings.TrimSpace(l.MaxRequestsPerMinute); value != "" {
+		if requests, err = strconv.Atoi(value); err != nil || requests < 0 {
+			return 0, 0, fmt.Errorf("max requests per minute has to be a positive number")
+		}
+	}
+	return rate, requests, nil
+}
+
+// options converts the form payload into download options, notifying the hooks of the
+// server. The hooks can only be set on the server: a webhook of the form would have the
+// server post signed requests to any URL.
+func (p JsonPayload) options(serverHooks *downloader.Hooks) (downloader.Options, error) {
+	rate, requests, err := p.Limits.parse()
+	if err != nil {
+		return downloader.Options{}, err
+	}
+	options := downloader.Options{
+		Username:  p.Username,
+		Password:  p.Password,
+		Crawl:     p.CrawlID,
+		Mode:      p.Mode,
+		NoDetails: !p.Details,
+		Filter:    p.Filter,
+		Order:     p.Order,
+		Output:    p.Output,
+		NoResume:  !p.Resume,
+		Where:     p.Where,
+
+		MaxRate:              rate,
+		MaxRequestsPerMinute: requests,
+	}
+	if p.Columns != "" {
+		options.Columns = strings.Split(p.Columns, ",")
+	}
+
+	if serverHooks != nil {
+		hooks := *serverHooks
+		options.Hooks = &hooks
+	}
+	return options, nil
 }
 
 type ProgressMessage struct {
 	ETA                  string `json:"ETA"`
+	TargetETA            string `json:"targetETA"`
+	Elapsed              string `json:"elapsed"`
+	RowsPerSecond        string `json:"rowsPerSecond"`
+	BytesPerSecond       int64  `json:"bytesPerSecond"`
 	ChunkSize            uint64 `json:"chunkSize,string"`
 	TotalElements        uint64 `json:"totalElements,string"`
 	DoneElements         uint64 `json:"doneElements,string"`
@@ -43,6 +113,9 @@ type ProgressMessage struct {
 	IsIngTargetMode      bool   `json:"isTargetMode"`
 	TotalIDsCount        int    `json:"totalIDsCount"`
 	CurrentIDOrderNumber int    `json:"currentIDOrderNumber"`
+	AnomaliesCount       int    `json:"anomaliesCount"`
+	MaxRate              int64  `json:"maxRate"`
+	MaxRequestsPerMinute int    `json:"maxRequestsPerMinute"`
 	Error                string `json:"error"`
 }
 
@@ -52,12 +125,16 @@ type WebDownloader struct {
 	APIDownloader   *downloader.Downloader
 	JSONPayload     JsonPayload
 	WebSocket       *melody.Melody
-	downloaderCount int // Restrict the number of parallel downloads
+	Logger          *downloader.Logger // nil unless --log-file is set
+	Hooks           *downloader.Hooks  // notified of every download, nil unless set by flags
+	downloaderCount int                // Restrict the number of parallel downloads
+	metrics         *metrics
 }
 
 // NewWebDownloader -
 func NewWebDownloader() *WebDownloader {
 	return &WebDownloader{
 		WebSocket: melody.New(),
+		metrics:   newMetrics(),
 	}
 }